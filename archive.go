@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// archiveTag is put on every restic snapshot lxcer makes, along with
+// key=value tags describing the container.
+const archiveTag = "lxcer"
+
+const (
+	tagHost      = "host"
+	tagContainer = "container"
+	tagRun       = "run"
+	tagType      = "type"
+	tagArch      = "arch"
+	tagVersion   = "version"
+)
+
+func tag(key, value string) string {
+	return key + "=" + value
+}
+
+// tagValue returns the value of the key=value tag among tags.
+func tagValue(tags []string, key string) (string, bool) {
+	for _, t := range tags {
+		if strings.HasPrefix(t, key+"=") {
+			return t[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// Archive is the backup of a container inside the restic repos. It is
+// namespaced by the host the container was backed up from, so containers
+// with the same name on different hosts keep their own history. Tags are
+// the restic tags of the archive; when looking an archive up, only
+// snapshots carrying all of them are considered. Snapshot (a restic
+// snapshot ID or a prefix of it) and At narrow the lookup further down to
+// that snapshot or to the newest one taken at or before At.
+type Archive struct {
+	Host      string
+	Container string
+	Tags      []string
+	Snapshot  string
+	At        time.Time
+}
+
+// parseArchive reads a restore source in the form host/container. A bare
+// container name leaves Host empty, it then matches any host.
+func parseArchive(s string) Archive {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return Archive{Container: s}
+	}
+	return Archive{Host: s[:i], Container: s[i+1:]}
+}
+
+// snapshotArchive tells which archive path p of snapshot s holds, if any.
+// The host and container tags win over the hostname and the file name, the
+// latter are all that snapshots taken before tagging have.
+func snapshotArchive(s resticSnapshot, p string) (Archive, bool) {
+	if !strings.HasSuffix(p, ".tar.zst") {
+		return Archive{}, false
+	}
+	a := Archive{Host: s.Hostname, Container: strings.TrimSuffix(path.Base(p), ".tar.zst"), Tags: s.Tags}
+	if h, ok := tagValue(s.Tags, tagHost); ok {
+		a.Host = h
+	}
+	if c, ok := tagValue(s.Tags, tagContainer); ok {
+		a.Container = c
+	}
+	return a, true
+}
+
+func (a Archive) String() string {
+	if a.Host == "" {
+		return a.Container
+	}
+	return a.Host + "/" + a.Container
+}
+
+// File is the path the archive is stored under, both in restic and while
+// staged in the working directory: host/container.tar.zst.
+func (a Archive) File() string {
+	return a.String() + ".tar.zst"
+}
+
+// Tar is the path of the uncompressed image while staged.
+func (a Archive) Tar() string {
+	return a.String() + ".tar"
+}
+
+// mkdir creates the directory the archive is staged in.
+func (a Archive) mkdir() error {
+	if a.Host == "" {
+		return nil
+	}
+	return os.MkdirAll(a.Host, 0700)
+}
+
+// Matches tells whether b is the same archive and carries all tags of a.
+// An empty host or container of a matches any.
+func (a Archive) Matches(b Archive) bool {
+	if a.Container != "" && a.Container != b.Container {
+		return false
+	}
+	if a.Host != "" && a.Host != b.Host {
+		return false
+	}
+	for _, t := range a.Tags {
+		if !contains(b.Tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// resticArgs are the restic backup flags that store the archive under its
+// host and tags.
+func (a Archive) resticArgs() []string {
+	args := []string{"--host", a.Host}
+	for _, t := range a.Tags {
+		args = append(args, "--tag", t)
+	}
+	return args
+}
+
+// archiveHost is the name archives of containers on the LXD remote host
+// are stored under. Local containers are stored under the hostname of this
+// machine, so that several machines can back up into the same repo.
+func archiveHost(host string) string {
+	if host != localHost {
+		return host
+	}
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return localHost
+	}
+	return name
+}
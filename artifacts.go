@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of artifacts a run leaves behind until it cleans up.
+const (
+	artifactSnapshot = "snapshot"
+	artifactImage    = "image"
+	artifactFile     = "file"
+)
+
+// artifact is something the run created outside of restic: a snapshot of a
+// container or an image on an LXD host, or a file in the working directory.
+type artifact struct {
+	kind      string
+	host      string
+	container string
+	name      string
+}
+
+func snapshotArtifact(host, container, name string) artifact {
+	return artifact{kind: artifactSnapshot, host: host, container: container, name: name}
+}
+
+func imageArtifact(host, alias string) artifact {
+	return artifact{kind: artifactImage, host: host, name: alias}
+}
+
+func fileArtifact(path string) artifact {
+	return artifact{kind: artifactFile, name: path}
+}
+
+func (a artifact) String() string {
+	switch a.kind {
+	case artifactSnapshot:
+		return fmt.Sprintf("snapshot %s/%s of %s", a.container, a.name, a.host)
+	case artifactImage:
+		return fmt.Sprintf("image %s on %s", a.name, a.host)
+	}
+	return a.name
+}
+
+// artifacts is what the run created and has not removed yet. Everything
+// is added before it is created, so that an operation cut short still
+// leaves a trace, and drops out once it is deleted.
+type artifacts struct {
+	mu    sync.Mutex
+	items []artifact
+}
+
+var created = &artifacts{}
+
+func (aa *artifacts) add(a artifact) {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	for _, b := range aa.items {
+		if b == a {
+			return
+		}
+	}
+	aa.items = append(aa.items, a)
+}
+
+func (aa *artifacts) done(a artifact) {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	for i, b := range aa.items {
+		if b == a {
+			aa.items = append(aa.items[:i], aa.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (aa *artifacts) list() []artifact {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	return append([]artifact{}, aa.items...)
+}
+
+// rollbackTimeout bounds the clean up at the end of a run, LXD hosts that
+// do not answer anymore must not keep lxcer from exiting.
+const rollbackTimeout = 5 * time.Minute
+
+// rollback removes every artifact that is still around, newest first.
+// Artifacts that turn out to be gone already, e.g. because creating them
+// failed, are dropped quietly.
+func (aa *artifacts) rollback() {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	items := aa.list()
+	for i := len(items) - 1; i >= 0; i-- {
+		a := items[i]
+		var err error
+		switch a.kind {
+		case artifactSnapshot:
+			c := Container{Name: a.container, Host: a.host}
+			err = c.DeleteSnapshot(ctx, a.name)
+		case artifactImage:
+			err = DeleteImage(ctx, a.host, a.name)
+		case artifactFile:
+			err = removeFile(a.name)
+		}
+		switch {
+		case isNotFound(err) || os.IsNotExist(err):
+			aa.done(a)
+		case err != nil:
+			log.WithField("artifact", a.String()).Errorf("Cannot roll back: %v", err)
+		default:
+			log.Infof("Roll back: delete %s", a)
+		}
+	}
+}
+
+// removeFile deletes a file the run created.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		created.done(fileArtifact(path))
+	}
+	return err
+}
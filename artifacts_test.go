@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useArtifacts gives the test an empty list of created artifacts.
+func useArtifacts(t *testing.T) *artifacts {
+	old := created
+	created = &artifacts{}
+	t.Cleanup(func() { created = old })
+	return created
+}
+
+func TestArtifactsRollback(t *testing.T) {
+	inTempDir(t)
+	aa := useArtifacts(t)
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+
+	sn := ownPrefix + "r1"
+	f.handle("DELETE /1.0/instances/c1/snapshots/"+sn, lxdSync(nil))
+	f.handle("GET /1.0/images/aliases/a1", lxdSync(map[string]string{"target": "fp1"}))
+	f.handle("GET /1.0/images/fp1", lxdSync(map[string]interface{}{
+		"fingerprint": "fp1", "properties": map[string]string{runProperty: "r1"},
+	}))
+	f.handle("DELETE /1.0/images/fp1", lxdSync(nil))
+	err := ioutil.WriteFile("c1.tar", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manual := snapshotArtifact("h1", "c1", "manual")
+	for _, a := range []artifact{
+		snapshotArtifact("h1", "c1", sn),
+		manual,
+		imageArtifact("h1", "a1"),
+		// Creating them failed before there was anything
+		snapshotArtifact("h1", "c2", sn),
+		imageArtifact("h1", "a2"),
+		fileArtifact("c1.tar.zst"),
+		fileArtifact("c1.tar"),
+	} {
+		aa.add(a)
+	}
+	aa.rollback()
+
+	if _, err := os.Stat("c1.tar"); !os.IsNotExist(err) {
+		t.Error("c1.tar was not removed")
+	}
+	var deleted []string
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "DELETE ") {
+			deleted = append(deleted, r)
+		}
+	}
+	want := []string{
+		"DELETE /1.0/instances/c2/snapshots/" + sn,
+		"DELETE /1.0/images/fp1",
+		"DELETE /1.0/instances/c1/snapshots/" + sn,
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %q, want newest first %q", deleted, want)
+	}
+	// Only the snapshot lxcer must not delete is left
+	if left := aa.list(); !reflect.DeepEqual(left, []artifact{manual}) {
+		t.Errorf("left %v, want %v", left, manual)
+	}
+}
+
+func TestDeleteSnapshotNotOwn(t *testing.T) {
+	useArtifacts(t)
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("DELETE /1.0/instances/c1/snapshots/manual", lxdSync(nil))
+
+	c := Container{Name: "c1", Host: "h1"}
+	err := c.DeleteSnapshot(context.Background(), "manual")
+	if err == nil || !strings.Contains(err.Error(), "Refusing") {
+		t.Errorf("err = %v, want a refusal", err)
+	}
+	if f.requested("DELETE /1.0/instances/c1/snapshots/manual") {
+		t.Error("snapshot lxcer did not take was deleted")
+	}
+}
+
+func TestDeleteImageNotOwn(t *testing.T) {
+	useArtifacts(t)
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("GET /1.0/images/aliases/ubuntu", lxdSync(map[string]string{"target": "fp1"}))
+	f.handle("GET /1.0/images/fp1", lxdSync(map[string]interface{}{"fingerprint": "fp1"}))
+	f.handle("DELETE /1.0/images/fp1", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("image lxcer did not create was deleted")
+		lxdSync(nil)(w, r)
+	})
+
+	err := DeleteImage(context.Background(), "h1", "ubuntu")
+	if err == nil || !strings.Contains(err.Error(), "Refusing") {
+		t.Errorf("err = %v, want a refusal", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// uploadSlots is the most restic processes a backup runs at once that
+// upload: one per repo and container in the stream stage, the workers of
+// every repo otherwise, plus the workers copying to replicas.
+func uploadSlots(config *Config) int {
+	slots := 0
+	if config.Stream {
+		w := config.LocalWorkers
+		if w < 1 {
+			w = 1
+		}
+		slots = w * len(config.uploadRepos())
+	} else {
+		for _, r := range config.uploadRepos() {
+			slots += r.workers()
+		}
+	}
+	for _, r := range config.replicaRepos() {
+		slots += r.workers()
+	}
+	return slots
+}
+
+// bandwidth hands the upload budget of a run (in KiB/s) out to the restic
+// processes as they start. restic takes its limit when it starts, so a
+// share stays taken until the process is done. Every upload gets an equal
+// share among the uploads running with it, out of what those left, but
+// never less than the budget divided by the slots. A nil bandwidth has no
+// budget.
+type bandwidth struct {
+	mu      sync.Mutex
+	budget  int
+	least   int
+	used    int
+	running int
+	// freed is closed and replaced whenever a share is given back
+	freed chan struct{}
+}
+
+func newBandwidth(budget, slots int) *bandwidth {
+	if budget <= 0 {
+		return nil
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	least := budget / slots
+	if least < 1 {
+		least = 1
+	}
+	return &bandwidth{budget: budget, least: least, freed: make(chan struct{})}
+}
+
+// limit returns the repos with their upload limit lowered to the share
+// of the uploads that are about to start in them, waiting until enough of
+// the budget is free. All repos get their share at once, so that a stream
+// to several repos never holds some shares while waiting for the rest. A
+// repo that has a lower limit of its own keeps it. release gives the
+// shares back once restic is done.
+func (b *bandwidth) limit(ctx context.Context, repos []ResticRepo) (rr []ResticRepo, release func(), err error) {
+	if b == nil || len(repos) == 0 {
+		return repos, func() {}, nil
+	}
+	n := len(repos)
+	need := n * b.least
+	if need > b.budget {
+		need = b.budget
+	}
+	var free int
+	for {
+		b.mu.Lock()
+		free = b.budget - b.used
+		if free >= need {
+			break
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	defer b.mu.Unlock()
+
+	share := b.budget / (b.running + n)
+	if share*n > free {
+		share = free / n
+	}
+	if share < 1 {
+		share = 1
+	}
+	taken := 0
+	rr = make([]ResticRepo, n)
+	for i, r := range repos {
+		if r.LimitUpload == 0 || r.LimitUpload > share {
+			r.LimitUpload = share
+		}
+		taken += r.LimitUpload
+		rr[i] = r
+	}
+	b.used += taken
+	b.running += n
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.used -= taken
+			b.running -= n
+			close(b.freed)
+			b.freed = make(chan struct{})
+		})
+	}
+	return rr, release, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUploadSlots(t *testing.T) {
+	repos := []ResticRepo{{Path: "one", Workers: 2}, {Path: "two"}, {Path: "three", Workers: 3}}
+	tests := []struct {
+		name   string
+		config Config
+		want   int
+	}{
+		{name: "upload", config: Config{BackupResticRepos: repos}, want: 6},
+		{name: "stream", config: Config{BackupResticRepos: repos, Stream: true, LocalWorkers: 2}, want: 6},
+		{name: "stream one worker", config: Config{BackupResticRepos: repos, Stream: true}, want: 3},
+		{name: "replicate", config: Config{BackupResticRepos: repos, Replicate: true}, want: 6},
+		{name: "stream and replicate", config: Config{BackupResticRepos: repos, Stream: true, LocalWorkers: 2, Replicate: true}, want: 6},
+		{name: "no repos", config: Config{}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uploadSlots(&tt.config); got != tt.want {
+				t.Errorf("uploadSlots = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// limits takes the shares of repos from b and returns their upload limits.
+func limits(t *testing.T, b *bandwidth, repos ...ResticRepo) ([]int, func()) {
+	t.Helper()
+	rr, release, err := b.limit(context.Background(), repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ll []int
+	for _, r := range rr {
+		ll = append(ll, r.LimitUpload)
+	}
+	return ll, release
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	b := newBandwidth(1000, 4)
+
+	// A lone upload gets it all, the next wait for their least share
+	first, release := limits(t, b, ResticRepo{Path: "one"})
+	if first[0] != 1000 {
+		t.Fatalf("lone upload got %d KiB/s, want 1000", first[0])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, _, err := b.limit(ctx, []ResticRepo{{Path: "two"}})
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want to wait for a share", err)
+	}
+	release()
+	release()
+
+	// A stream takes a share for every repo at once, a repo with a lower
+	// limit keeps it
+	stream, releaseStream := limits(t, b, ResticRepo{Path: "one"}, ResticRepo{Path: "two", LimitUpload: 100})
+	if stream[0] != 500 || stream[1] != 100 {
+		t.Errorf("stream got %v KiB/s, want [500 100]", stream)
+	}
+	// The next upload splits the budget three ways, out of the 400 left
+	next, releaseNext := limits(t, b, ResticRepo{Path: "three"})
+	if next[0] != 333 {
+		t.Errorf("next upload got %d KiB/s, want 333", next[0])
+	}
+
+	// 67 KiB/s are left, less than the least share
+	done := make(chan int)
+	go func() {
+		rr, release, _ := b.limit(context.Background(), []ResticRepo{{Path: "four"}})
+		release()
+		done <- rr[0].LimitUpload
+	}()
+	select {
+	case l := <-done:
+		t.Fatalf("upload got %d KiB/s of a used up budget", l)
+	case <-time.After(10 * time.Millisecond):
+	}
+	releaseStream()
+	if l := <-done; l != 500 {
+		t.Errorf("upload got %d KiB/s once the stream was done, want 500", l)
+	}
+	releaseNext()
+	if b.used != 0 || b.running != 0 {
+		t.Errorf("%d KiB/s and %d uploads still taken", b.used, b.running)
+	}
+}
+
+func TestBandwidthNoBudget(t *testing.T) {
+	b := newBandwidth(0, 4)
+	ll, release := limits(t, b, ResticRepo{Path: "one"}, ResticRepo{Path: "two", LimitUpload: 100})
+	release()
+	if ll[0] != 0 || ll[1] != 100 {
+		t.Errorf("limits = %v, want [0 100]", ll)
+	}
+}
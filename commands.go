@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// command is a lxcer subcommand. Besides -config and -log-level, which
+// every command has, flags registers the options the command understands.
+type command struct {
+	name    string
+	summary string
+	help    string
+	// stream tells whether the command accepts -stream
+	stream bool
+	// graceful commands let the containers under way finish when stopped
+	graceful bool
+	flags    func(fs *flag.FlagSet, o *Options)
+	run      func(ctx context.Context, c *Config)
+}
+
+var commands = []command{
+	{
+		name:    "backup",
+		summary: "Back containers up to every backup repo",
+		help: `Backs up every running container that is not blacklisted, from all hosts
+of the config, from a single host with -remote-host or from the local LXD
+with -local. The archives are pushed to every backup_restic_repos entry.`,
+		stream:   true,
+		graceful: true,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.StringVar(&o.RemoteHost, "remote-host", "", "Back up this host instead of the hosts from config")
+			fs.BoolVar(&o.Local, "local", false, "Back up local containers instead of remote hosts")
+			fs.StringVar(&o.Container, "container", "", "Back up only this container, even if it is stopped or blacklisted")
+			fs.BoolVar(&o.Cleanup, "cleanup", false, "Delete local containers and images before backing up")
+			fs.BoolVar(&o.Concurrently, "concurrently", false, "Run the pipeline stages concurrently")
+		},
+		run: Backup,
+	},
+	{
+		name:    "restore",
+		summary: "Restore containers from the restore repos",
+		help: `Restores the latest backup of a container (-container and -as) or of every
+container from a list (-restore-list) to a remote host (-remote-host) or to
+the local LXD (-local), and starts it. -snapshot or -at pick an older
+backup instead.`,
+		stream:   true,
+		graceful: true,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.StringVar(&o.RemoteHost, "remote-host", "", "Host to restore containers to")
+			fs.BoolVar(&o.Local, "local", false, "Restore containers to the local LXD")
+			fs.StringVar(&o.Container, "container", "", "Container to restore as host/container, the host may be left out if the name is unique")
+			fs.StringVar(&o.RestoreAs, "as", "", "Restore-name of the container")
+			fs.StringVar(&o.RestoreList, "restore-list", "", "Path to list in format host/container_name:container_restore_name")
+			fs.BoolVar(&o.Cleanup, "cleanup", false, "Delete local containers and images before restoring")
+			fs.BoolVar(&o.Concurrently, "concurrently", false, "Start containers while the next ones are being imported")
+			fs.Var(&o.Tags, "tag", "Only restore from snapshots with this restic tag, e.g. run=<run id> (repeatable)")
+			fs.StringVar(&o.Snapshot, "snapshot", "", "Restore this restic snapshot ID instead of the latest one (-container only)")
+			fs.Var(&o.At, "at", "Restore the newest snapshot taken at or before this time, e.g. 2024-01-02 or 2024-01-02T15:04")
+		},
+		run: Restore,
+	},
+	{
+		name:    "list",
+		summary: "List backups found in the restic repos",
+		help: `Lists every backup of every container found in the configured restic repos:
+when it was taken, from which host, its size, and the snapshot IDs and
+repos holding it.`,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.StringVar(&o.Container, "container", "", "List backups of this container (or host/container) only")
+			fs.Var(&o.Tags, "tag", "List only snapshots with this restic tag, e.g. type=virtual-machine (repeatable)")
+			fs.BoolVar(&o.JSON, "json", false, "Print JSON instead of a table")
+		},
+		run: List,
+	},
+	{
+		name:    "verify",
+		summary: "Same as repo check",
+		help:    `Runs restic check against every configured restic repo.`,
+		flags:   checkFlags,
+		run:     RepoCheck,
+	},
+	{
+		name:    "prune",
+		summary: "Forget old backups by the retention policies and prune the restic repos",
+		help: `Runs restic forget with the retention policy of every container in every
+configured restic repo, then restic prune to free the space. -dry-run only
+shows which snapshots would be forgotten. Without a policy a container keeps
+all its snapshots.`,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.BoolVar(&o.DryRun, "dry-run", false, "Only show what would be forgotten")
+		},
+		run: Prune,
+	},
+	{
+		name:    "status",
+		summary: "Show what would be backed up and whether hosts and repos are reachable",
+		help: `Lists the containers of every host, or of a single one with -remote-host or
+-local, and the snapshots of every restic repo. Nothing is changed.`,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.StringVar(&o.RemoteHost, "remote-host", "", "Show this host instead of the hosts from config")
+			fs.BoolVar(&o.Local, "local", false, "Show the local LXD instead of remote hosts")
+		},
+		run: Status,
+	},
+	{
+		name:    "repo init",
+		summary: "Create the restic repos that do not exist yet",
+		help: `Runs restic init for every configured restic repo that cannot be opened yet.
+With replicate, the replicas are created with the chunker parameters of the
+primary repo so that restic copy deduplicates.`,
+		run: RepoInit,
+	},
+	{
+		name:    "repo check",
+		summary: "Check the integrity of the restic repos",
+		help: `Runs restic check against every configured restic repo. It takes a while, so
+schedule it apart from the backups. -read-data-subset also reads and
+verifies part of the data, e.g. 10% every night or 1/7 .. 7/7 over a week.`,
+		flags: checkFlags,
+		run:   RepoCheck,
+	},
+	{
+		name:    "repo unlock",
+		summary: "Remove stale locks from the restic repos",
+		help:    `Runs restic unlock against every configured restic repo.`,
+		flags: func(fs *flag.FlagSet, o *Options) {
+			fs.BoolVar(&o.RemoveAll, "remove-all", false, "Remove all locks, even those of running restic processes")
+		},
+		run: RepoUnlock,
+	},
+	{
+		name:    "repo stats",
+		summary: "Show the storage every container takes up in the restic repos",
+		help: `Prints the deduplicated size of the snapshots of every container and of the
+whole repo, for every configured restic repo.`,
+		run: RepoStats,
+	},
+}
+
+func checkFlags(fs *flag.FlagSet, o *Options) {
+	fs.StringVar(&o.ReadDataSubset, "read-data-subset", "", "Also read and verify this part of the data, e.g. 10% or 1/5")
+}
+
+// tagList collects the values of a repeatable -tag flag.
+type tagList []string
+
+func (t *tagList) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagList) Set(v string) error {
+	*t = append(*t, v)
+	return nil
+}
+
+// timeFlag is a point in time given as RFC 3339 or, in local time, as a
+// date with an optional time of day.
+type timeFlag struct {
+	time.Time
+}
+
+var timeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(v string) error {
+	if pt, err := time.Parse(time.RFC3339, v); err == nil {
+		t.Time = pt
+		return nil
+	}
+	for _, layout := range timeLayouts {
+		if pt, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			t.Time = pt
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a time, use e.g. 2024-01-02T15:04 or RFC 3339", v)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: lxcer <command> [flags]\n\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nRun 'lxcer <command> -h' to see the flags of a command.\n")
+}
+
+// findCommand returns the command args start with, which may take several
+// words as in "repo check", along with the args that follow it.
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	n := 1
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		n = 2
+	}
+	return nil, args[:n]
+}
+
+// runCommand parses the flags of the command named by args[0], loads the
+// config and runs the command.
+func runCommand(args []string) {
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		return
+	}
+	if strings.HasPrefix(args[0], "-") {
+		log.Fatalln("Please provide a command as the first argument, e.g. `lxcer backup -config conf.yml` (the -a flag is gone)")
+	}
+
+	cmd, args := findCommand(args)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+		usage()
+		os.Exit(2)
+	}
+
+	var (
+		o        Options
+		path     string
+		logLevel string
+		stream   bool
+	)
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.StringVar(&path, "config", "", "Path to YAML config")
+	fs.StringVar(&logLevel, "log-level", "error", "Log level: debug, info, warn or error")
+	if cmd.stream {
+		fs.BoolVar(&stream, "stream", false, "Stream images between LXD, zstd and restic without temporary files")
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs, &o)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: lxcer %s [flags]\n\n%s\n\nFlags:\n", cmd.name, cmd.help)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	lv, err := log.ParseLevel(logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.SetLevel(lv)
+
+	c := loadConfig(path, o)
+	c.Stream = c.Stream || stream
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(cancel, cmd.graceful, c.gracePeriod())
+	cmd.run(ctx, c)
+}
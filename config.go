@@ -2,10 +2,10 @@ package main
 
 import (
 	"bufio"
-	"flag"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,77 +17,93 @@ type Config struct {
 	Blacklist         []string     `yaml:"blacklist"`
 	BackupResticRepos []ResticRepo `yaml:"backup_restic_repos"`
 	RestoreResticRepo ResticRepo   `yaml:"restore_restic_repo"`
-	LocalWorkers      int          `yaml:"local_workers"`
-	ActionType        string
-	Cleanup           bool
-	Concurrently      bool
-	Local             bool
-	ContList          contList
+	// RestoreResticRepos are tried in order on restore
+	RestoreResticRepos []ResticRepo         `yaml:"restore_restic_repos"`
+	LocalWorkers       int                  `yaml:"local_workers"`
+	Remotes            map[string]LXDRemote `yaml:"remotes"`
+	Stream             bool                 `yaml:"stream"`
+	// Replicate uploads to the first backup repo only and fills the
+	// others with restic copy
+	Replicate bool `yaml:"replicate"`
+	// Quorum is how many backup repos a container must reach
+	Quorum Quorum `yaml:"quorum"`
+	// Retry is the retry policy of every stage, StageRetry overrides it
+	// per stage
+	Retry      RetryPolicy            `yaml:"retry"`
+	StageRetry map[string]RetryPolicy `yaml:"stage_retry"`
+	// Timeout is how long an attempt of a backup stage or a step of a
+	// restore may take, StageTimeout overrides it per stage or step. Unset
+	// means no limit.
+	Timeout      time.Duration            `yaml:"timeout"`
+	StageTimeout map[string]time.Duration `yaml:"stage_timeout"`
+	// GracePeriod is how long a stopped backup or restore waits for the
+	// containers under way before it cancels them
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// StaleAfter is how old a run must be before a backup deletes the
+	// snapshots and images it left behind
+	StaleAfter time.Duration `yaml:"stale_after"`
+	// LimitUpload is the upload bandwidth in KiB/s of the run, shared by
+	// the uploads running at once
+	LimitUpload int `yaml:"limit_upload"`
+	// Retention is the default policy, overridden per repo and per
+	// container (host/container or container) in ContainerRetention
+	Retention          Retention            `yaml:"retention"`
+	ContainerRetention map[string]Retention `yaml:"container_retention"`
+	Options            `yaml:"-"`
 }
 
-type RestoreContainer struct {
-	Name        string
-	RestoreName string
+// Options are set from the command line flags of the subcommand.
+type Options struct {
+	RemoteHost     string
+	Container      string
+	RestoreAs      string
+	RestoreList    string
+	Cleanup        bool
+	Concurrently   bool
+	Local          bool
+	Tags           tagList
+	Snapshot       string
+	At             timeFlag
+	JSON           bool
+	DryRun         bool
+	ReadDataSubset string
+	RemoveAll      bool
+	ContList       contList
 }
 
 type contList map[string]string
 
-var (
-	logLevel           = flag.String("log-level", "error", "Remote host name to restore containers to")
-	remoteHost         = flag.String("remote-host", "", "Remote host name to restore/backup containers to")
-	restoreContainerAs = flag.String("as", "", "Restore-name of the container")
-	flagContainer      = flag.String("container", "", "Name of the container to restore/backup")
-	restoreList        = flag.String("restore-list", "", "Path to list in format container_name:container_restore_name")
-	fileName           = flag.String("config", "", "Path to YAML config.")
-	actionType         = flag.String("a", "", "Action to take (backup or restore)")
-	cleanup            = flag.Bool("cleanup", false, "Delete local containers and images before processing")
-	concurrently       = flag.Bool("concurrently", false, "Backup concurrently")
-	local              = flag.Bool("local", false, "Backup local containers")
-)
-
 func init() {
 	log.SetFormatter(&log.TextFormatter{
 		DisableColors: true,
 	})
 }
 
-func loadConfig() *Config {
-	flag.Parse()
-
-	lv, err := log.ParseLevel(*logLevel)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	log.SetLevel(lv)
-
-	if *fileName == "" {
+// loadConfig reads the YAML config and completes it with the options
+// parsed from the command line.
+func loadConfig(path string, o Options) *Config {
+	if path == "" {
 		log.Fatalf(`Please provide path to yaml config file by using -config flag`)
 	}
 
-	if *actionType == "" {
-		log.Fatalf(`Please provide action type with -a flag (backup or restore)`)
-	}
-
-	c := readConfig(*fileName)
+	c := readConfig(path)
+	c.Options = o
 
-	if *restoreList != "" {
-		cl, err := LoadContainerList(*restoreList)
+	if o.RestoreList != "" {
+		cl, err := LoadContainerList(o.RestoreList)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		c.ContList = cl
 	}
 
-	c.ActionType = *actionType
-	c.Cleanup = *cleanup
-	c.Local = *local
-	c.Concurrently = *concurrently
+	lxdRemotes = c.Remotes
 
 	return &c
 }
 
 func readConfig(path string) Config {
-	yamlFile, err := ioutil.ReadFile(*fileName)
+	yamlFile, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatalf("Error reading YAML file: %s", err)
 	}
@@ -98,9 +114,48 @@ func readConfig(path string) Config {
 		log.Fatalf("Error parsing YAML file: %s", err)
 	}
 
+	repos := append([]ResticRepo{c.RestoreResticRepo}, c.BackupResticRepos...)
+	for _, r := range append(repos, c.RestoreResticRepos...) {
+		err = r.validate()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	return c
 }
 
+// restoreRepos are the repos restore tries in order: restore_restic_repos
+// if set, otherwise restore_restic_repo followed by every backup repo.
+func (c *Config) restoreRepos() []ResticRepo {
+	if len(c.RestoreResticRepos) > 0 {
+		return c.RestoreResticRepos
+	}
+	var rr []ResticRepo
+	if c.RestoreResticRepo.Path != "" {
+		rr = append(rr, c.RestoreResticRepo)
+	}
+	for _, r := range c.BackupResticRepos {
+		if r.Path != c.RestoreResticRepo.Path {
+			rr = append(rr, r)
+		}
+	}
+	return rr
+}
+
+// resticRepos returns every configured repo once, backup repos first.
+func (c *Config) resticRepos() []ResticRepo {
+	var rr []ResticRepo
+	seen := map[string]bool{}
+	for _, r := range append(append([]ResticRepo{}, c.BackupResticRepos...), c.restoreRepos()...) {
+		if !seen[r.Path] {
+			seen[r.Path] = true
+			rr = append(rr, r)
+		}
+	}
+	return rr
+}
+
 func LoadContainerList(path string) (contList, error) {
 	var cl contList = make(map[string]string)
 
@@ -1,349 +1,251 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type Container struct {
-	Name       string     `json:"name"`
-	StatusCode int        `json:"status_code"`
-	Snapshots  []Snapshot `json:"snapshots"`
-	Host       string
+	Name         string     `json:"name"`
+	StatusCode   int        `json:"status_code"`
+	Type         string     `json:"type"`
+	Architecture string     `json:"architecture"`
+	Snapshots    []Snapshot `json:"snapshots"`
+	Host         string
+	// Uploads are the restic snapshots this run saved of the container,
+	// UploadErrors the repos it failed to reach and Retries the errors it
+	// was retried after
+	Uploads      []backupSummary `json:"-"`
+	UploadErrors []string        `json:"-"`
+	Retries      []string        `json:"-"`
 }
 
 type Snapshot struct {
 	Name string `json:"name"`
 }
 
-func (c *Container) DeleteSnapshots() error {
-	for _, s := range c.Snapshots {
-		err := c.DeleteSnapshot(s.Name)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// lxd returns the client of the host the container lives on.
+func (c *Container) lxd() (*LXDClient, error) {
+	return lxdClient(c.host())
 }
 
-func (c *Container) DeleteSnapshotsRemote(host string) error {
-	for _, s := range c.Snapshots {
-		err := c.DeleteSnapshotRemote(s.Name, host)
-		if err != nil {
-			return err
-		}
+// host returns the name of the LXD remote the container lives on.
+func (c *Container) host() string {
+	if c.Host == "" {
+		return localHost
 	}
-	return nil
+	return c.Host
 }
 
-func (c *Container) SnapshotExists(sn string) bool {
-	var snn []string
-	for _, s := range c.Snapshots {
-		snn = append(snn, s.Name)
+// archive is the archive the container is backed up as, tagged with where
+// it comes from and what it is.
+func (c *Container) archive() Archive {
+	host := archiveHost(c.host())
+	tags := []string{
+		archiveTag,
+		tag(tagHost, host),
+		tag(tagContainer, c.Name),
+		tag(tagRun, runID),
+		tag(tagType, c.instanceType()),
+		tag(tagVersion, version),
 	}
-	if contains(snn, sn) {
-		return true
+	if c.Architecture != "" {
+		tags = append(tags, tag(tagArch, c.Architecture))
 	}
-	return false
+	return Archive{Host: host, Container: c.Name, Tags: tags}
 }
 
-func (c *Container) Delete() error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-
-	cmd := exec.Command("lxc", "delete", "%s", "--force")
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
+// recordUploads keeps the outcome of uploading the container to repos,
+// sums and errs being the result for each repo. Whether the failures matter
+// is up to the quorum.
+func (c *Container) recordUploads(repos []ResticRepo, sums []backupSummary, errs []error) {
+	for i, err := range errs {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":      c.Host,
+				"container": c.Name,
+				"repo":      repos[i].Path,
+			}).Error(err)
+			c.UploadErrors = append(c.UploadErrors, fmt.Sprintf("%s: %v", repos[i].Path, err))
+			continue
+		}
+		c.Uploads = append(c.Uploads, sums[i])
 	}
-	return nil
 }
 
-func (c *Container) DeleteRemote(host string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-
-	cmd := exec.Command("lxc", "delete", fmt.Sprintf("%s:", host), c.Name)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
+// uploaded tells whether the container already made it to repo r.
+func (c *Container) uploaded(r ResticRepo) bool {
+	for _, u := range c.Uploads {
+		if u.Repo == r.Path {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
-func (c *Container) DeleteSnapshot(sn string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-
-	cmd := exec.Command("lxc", "delete", fmt.Sprintf("%s/%s", c.Name, sn))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
+// missing returns the repos the container has not made it to yet.
+func (c *Container) missing(repos []ResticRepo) []ResticRepo {
+	var mm []ResticRepo
+	for _, r := range repos {
+		if !c.uploaded(r) {
+			mm = append(mm, r)
+		}
 	}
-	return nil
+	return mm
 }
 
-func (c *Container) DeleteSnapshotRemote(sn string, host string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "delete", fmt.Sprintf("%s:%s/%s", host, c.Name, sn))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
+// instanceType is the LXD instance type, older LXD only knows containers.
+func (c *Container) instanceType() string {
+	if c.Type == "" {
+		return "container"
 	}
-	return nil
+	return c.Type
 }
 
-func (c *Container) CreateSnapshotLocal(sn string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "snapshot", fmt.Sprintf("%s", c.Name), sn)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
-	}
-	return nil
+// alias is the alias of the image this run publishes of the container.
+func (c *Container) alias() string {
+	return runAlias(c.host(), c.Name)
 }
 
-func (c *Container) CreateSnapshotRemote(sn string, host string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "snapshot", fmt.Sprintf("%s:%s", host, c.Name), sn)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+func (c *Container) Delete(ctx context.Context) error {
+	l, err := c.lxd()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	return l.DeleteContainer(ctx, c.Name)
 }
 
-func (c *Container) CopySnapshot(sn string, host string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "copy", fmt.Sprintf("%s:%s/%s", host, c.Name, sn), c.Name)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// DeleteSnapshot removes a snapshot lxcer has taken, any other snapshot is
+// left alone.
+func (c *Container) DeleteSnapshot(ctx context.Context, sn string) error {
+	if !ownSnapshot(sn) {
+		return fmt.Errorf("Refusing to delete snapshot %s of %s, it was not taken by lxcer", sn, c.Name)
+	}
+	l, err := c.lxd()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	err = l.DeleteSnapshot(ctx, c.Name, sn)
+	if err == nil {
+		created.done(snapshotArtifact(c.host(), c.Name, sn))
+	}
+	return err
 }
 
-func (c *Container) PublishRemote(sn, host string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "publish", fmt.Sprintf("%s:%s/%s", host, c.Name, sn), "--alias", c.Name, "--compression", "none")
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+func (c *Container) CreateSnapshot(ctx context.Context, sn string) error {
+	l, err := c.lxd()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	created.add(snapshotArtifact(c.host(), c.Name, sn))
+	return l.CreateSnapshot(ctx, c.Name, sn)
 }
 
-func (c *Container) PublishContainer() error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "publish", c.Name, "--alias", c.Name, "--compression", "none")
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// PublishSnapshot publishes the snapshot as an image on the container's
+// host under the alias of this run.
+func (c *Container) PublishSnapshot(ctx context.Context, sn string) error {
+	l, err := c.lxd()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	created.add(imageArtifact(c.host(), c.alias()))
+	_, err = l.Publish(ctx, c.Name, sn, c.alias(), imageProperties(c.host(), c.Name))
+	return err
 }
 
-func (c *Container) PublishSnapshot(sn string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "publish", fmt.Sprintf("%s/%s", c.Name, sn), "--alias", c.Name, "--compression", "none")
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// ExportImage downloads the published image to <host>/<name>.tar.
+func (c *Container) ExportImage(ctx context.Context) error {
+	l, err := c.lxd()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
-}
-
-func (c *Container) ExportImage() error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "image", "export", c.Name, c.Name)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+	a := c.archive()
+	err = a.mkdir()
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
-}
-
-func StartContainerFromImageLocal(cname string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "launch", cname, cname)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+	tar := a.Tar()
+	created.add(fileArtifact(tar))
+	f, err := os.Create(tar)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
+	}
+	err = l.ExportImage(ctx, c.alias(), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	return nil
-}
-
-func StartContainerFromImageRemote(cname, rhost string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "launch", fmt.Sprintf("%s:%s", rhost, cname), fmt.Sprintf("%s:%s", rhost, cname))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
 	if err != nil {
-		return errors.New(Stderr.String())
+		removeFile(tar)
+		return err
 	}
 	return nil
 }
 
-func ImportImage(path, as string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "image", "import", path, "--alias", as)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
-	}
-	return nil
+// DeleteImage removes the published image from the container's host.
+func (c *Container) DeleteImage(ctx context.Context) error {
+	return DeleteImage(ctx, c.host(), c.alias())
 }
 
-func ImportImageRemote(path, as, rhost string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "image", "import", path, fmt.Sprintf("%s:", rhost), "--alias", as)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// ImportImage uploads the image tarball at path to host as alias, marked as
+// created by this run.
+func ImportImage(ctx context.Context, host, path, alias, container string) error {
+	l, err := lxdClient(host)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
-}
-
-func DeleteImage(cname string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "image", "delete", cname)
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+	f, err := os.Open(path)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	defer f.Close()
+	created.add(imageArtifact(host, alias))
+	_, err = l.ImportImage(ctx, f, alias, imageProperties(host, container))
+	return err
 }
 
-func DeleteImageRemote(cname, rhost string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("lxc", "image", "delete", fmt.Sprintf("%s:%s", rhost, cname))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// DeleteImage removes the image behind alias from host, provided that
+// lxcer created it.
+func DeleteImage(ctx context.Context, host, alias string) error {
+	l, err := lxdClient(host)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
-}
-
-func DecompressWithZst(cname string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	// zstd -d -T0 cachet-mz.tar.zst -o cachet-mz.tar
-	cmd := exec.Command("zstd", "-d", "-T0", fmt.Sprintf("%s.tar.zst", cname), "-o", fmt.Sprintf("%s.tar", cname))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+	i, err := l.Image(ctx, alias)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	if !i.Own() {
+		return fmt.Errorf("Refusing to delete image %s on %s, it was not created by lxcer", alias, host)
+	}
+	err = l.DeleteImage(ctx, i.Fingerprint)
+	if err == nil {
+		created.done(imageArtifact(host, alias))
+	}
+	return err
 }
 
-func (c *Container) CompressWithZst() error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	// zstd c1.tar --rsyncable -o c1.tar.zst
-	cmd := exec.Command("zstd", fmt.Sprintf("%s.tar", c.Name), "-T0", "--rsyncable", "-o", fmt.Sprintf("%s.tar.zst", c.Name))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(Stderr.String())
-	}
-	return nil
+func DecompressWithZst(ctx context.Context, a Archive) error {
+	// zstd -d -T0 host-01/cachet-mz.tar.zst -o host-01/cachet-mz.tar
+	created.add(fileArtifact(a.Tar()))
+	_, err := zstd(ctx, "-d", "-T0", a.File(), "-o", a.Tar())
+	return err
+}
+
+func (c *Container) CompressWithZst(ctx context.Context) error {
+	// zstd host-01/c1.tar --rsyncable -o host-01/c1.tar.zst
+	a := c.archive()
+	created.add(fileArtifact(a.File()))
+	_, err := zstd(ctx, a.Tar(), "-T0", "--rsyncable", "-o", a.File())
+	return err
 }
 
-func DeleteImageTar(cname string) error {
-	return os.Remove(fmt.Sprintf("%s.tar", cname)) // remove a single file
+func DeleteImageTar(a Archive) error {
+	return removeFile(a.Tar())
 }
 
-func DeleteImageTarZst(cname string) error {
-	return os.Remove(fmt.Sprintf("%s.tar.zst", cname)) // remove a single file
+func DeleteImageTarZst(a Archive) error {
+	return removeFile(a.File())
 }
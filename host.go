@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"os/exec"
-	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
+const localHost = "local"
+
 type Host struct {
 	Name       string
 	Containers []Container
@@ -30,226 +26,44 @@ func toHost(string string) Host {
 	}
 }
 
-func (h *Host) Backup(config *Config) {
-	log := log.WithField("host", h.Name)
-	err := h.GetContainers()
-	if err != nil {
-		log.Error(err)
+// selectHosts returns the hosts a command works on: the local LXD with
+// -local, the one given with -remote-host or all hosts from config.
+func selectHosts(config *Config) []Host {
+	switch {
+	case config.Local:
+		return []Host{toHost(localHost)}
+	case config.RemoteHost != "":
+		return []Host{toHost(config.RemoteHost)}
+	default:
+		return toHosts(config.Hosts)
 	}
-	cc := filterContainers(h.Containers, config.Blacklist)
-	for _, c := range cc {
-		log = log.WithField("container", c.Name)
-
-		t := time.Now()
-		if c.SnapshotExists(sn) {
-			err := c.DeleteSnapshotRemote(sn, h.Name)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			log.WithField("spent", time.Since(t)).Infof("Delete remote snapshot %s", sn)
-		}
-
-		t = time.Now()
-		err = c.CreateSnapshotRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Create remote snapshot %s", sn)
-
-		t = time.Now()
-		err = c.PublishRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Publish remote snapshot %s as image", sn)
-
-		t = time.Now()
-		err = c.DeleteSnapshotRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete remote snapshot %s", sn)
-
-		t = time.Now()
-		err = c.ExportImage()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Export image as %s.tar", c.Name)
-
-		t = time.Now()
-		err = DeleteImage(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete image")
-
-		t = time.Now()
-		err = c.CompressWithZst()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Compress %s.tar to %s.tar.zst", c.Name, c.Name)
-
-		t = time.Now()
-		err = DeleteImageTar(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete %s.tar", c.Name)
-
-		for _, r := range config.BackupResticRepos {
-			t = time.Now()
-			err := r.Backup(fmt.Sprintf("%s.tar.zst", c.Name))
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			log.WithField("spent", time.Since(t)).Infof("Backup %s.tar.zst to %s", c.Name, r.Path)
-		}
-
-		t = time.Now()
-		err = DeleteImageTarZst(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete %s.tar.zst", c.Name)
-
-	}
-
 }
 
-func (h *Host) BackupOne(config *Config, container string) {
-	log := log.WithField("host", h.Name)
-	err := h.GetContainers()
+// backupCandidates lists containers of the host that should be backed up:
+// either the one requested with -container or every running container
+// that is not blacklisted.
+func (h *Host) backupCandidates(ctx context.Context, config *Config) ([]Container, error) {
+	err := h.GetContainers(ctx)
 	if err != nil {
-		log.Error(err)
+		return nil, err
 	}
-	cc := h.Containers
-	if !containerExists(cc, container) {
-		log.Error(fmt.Errorf("Container %v does not exist on remote host %v", container, h.Name))
-		return
+	if config.Container == "" {
+		return filterContainers(h.Containers, config.Blacklist), nil
 	}
-
-	for _, c := range cc {
-		// This code is embarassing I know
-		if c.Name != container {
-			continue
+	for _, c := range h.Containers {
+		if c.Name == config.Container {
+			return []Container{c}, nil
 		}
-		log = log.WithField("container", c.Name)
-
-		t := time.Now()
-		if c.SnapshotExists(sn) {
-			err := c.DeleteSnapshotRemote(sn, h.Name)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			log.WithField("spent", time.Since(t)).Infof("Delete snapshot")
-		}
-
-		t = time.Now()
-		err = c.CreateSnapshotRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Create remote snapshot %s", sn)
-
-		t = time.Now()
-		err = c.PublishRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Publish remote snapshot %s as image", sn)
-
-		t = time.Now()
-		err = c.DeleteSnapshotRemote(sn, h.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete remote snapshot %s", sn)
-
-		t = time.Now()
-		err = c.ExportImage()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Export image as %s.tar", c.Name)
-
-		t = time.Now()
-		err = DeleteImage(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete image")
-
-		t = time.Now()
-		err = c.CompressWithZst()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Compress %s.tar to %s.tar.zst", c.Name, c.Name)
-
-		t = time.Now()
-		err = DeleteImageTar(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete %s.tar", c.Name)
-
-		for _, r := range config.BackupResticRepos {
-			t = time.Now()
-			err := r.Backup(fmt.Sprintf("%s.tar.zst", c.Name))
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			log.WithField("spent", time.Since(t)).Infof("Backup %s.tar.zst to %s", c.Name, r.Path)
-		}
-
-		t = time.Now()
-		err = DeleteImageTarZst(c.Name)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		log.WithField("spent", time.Since(t)).Infof("Delete %s.tar.zst", c.Name)
-
 	}
-
+	return nil, fmt.Errorf("Container %v does not exist on host %v", config.Container, h.Name)
 }
 
-func (h *Host) GetContainers() error {
-	var (
-		cc     []Container
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-
-	cmd := exec.Command("lxc", "list", fmt.Sprintf("%s:", h.Name), "--format", "json")
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+func (h *Host) GetContainers(ctx context.Context) error {
+	l, err := lxdClient(h.Name)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	err = json.Unmarshal(Stdout.Bytes(), &cc)
+	cc, err := l.Containers(ctx)
 	if err != nil {
 		return err
 	}
@@ -259,12 +73,3 @@ func (h *Host) GetContainers() error {
 	}
 	return nil
 }
-
-func containerExists(cc []Container, name string) bool {
-	for _, c := range cc {
-		if c.Name == name {
-			return true
-		}
-	}
-	return false
-}
@@ -1,28 +1,23 @@
 package main
 
-import (
-	"bytes"
-	"errors"
-	"fmt"
-	"os/exec"
-)
+import "context"
 
 type Image struct {
-	Fingerprint string `json:"fingerprint"`
+	Fingerprint string            `json:"fingerprint"`
+	Type        string            `json:"type"`
+	Properties  map[string]string `json:"properties"`
 }
 
-func (i *Image) Delete() error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
+// Own tells whether the image was created by lxcer.
+func (i *Image) Own() bool {
+	return i.Properties[runProperty] != ""
+}
 
-	cmd := exec.Command("lxc", "image", "delete", fmt.Sprintf("%s", i.Fingerprint))
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+// Delete removes the image from the local LXD.
+func (i *Image) Delete(ctx context.Context) error {
+	l, err := lxdClient(localHost)
 	if err != nil {
-		return errors.New(Stderr.String())
+		return err
 	}
-	return nil
+	return l.DeleteImage(ctx, i.Fingerprint)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listEntry is a single backup of a container. The same backup lands in
+// every repo as a separate restic snapshot, they are grouped by the run
+// tag. Snapshots taken before tagging are grouped by their ID.
+type listEntry struct {
+	Host      string         `json:"host"`
+	Container string         `json:"container"`
+	Time      time.Time      `json:"time"`
+	Run       string         `json:"run,omitempty"`
+	Size      uint64         `json:"size,omitempty"`
+	Snapshots []listSnapshot `json:"snapshots"`
+	// sizeFrom holds a snapshot to ask restic stats for the size when none
+	// of them has a summary
+	sizeFrom ResticRepo
+	sizeID   string
+}
+
+type listSnapshot struct {
+	ID   string `json:"id"`
+	Repo string `json:"repo"`
+}
+
+// List prints the backups of every container found in the restic repos,
+// oldest first, along with the repos holding them.
+func List(ctx context.Context, config *Config) {
+	var (
+		ee     []*listEntry
+		runs   = map[string]*listEntry{}
+		failed bool
+	)
+	filter := parseArchive(config.Container)
+	filter.Tags = config.Tags
+	for _, r := range config.resticRepos() {
+		ss, err := r.Snapshots(ctx)
+		if err != nil {
+			log.WithField("repo", r.Path).Error(err)
+			failed = true
+			continue
+		}
+		for _, s := range ss {
+			for _, p := range s.Paths {
+				a, ok := snapshotArchive(s, p)
+				if !ok || !filter.Matches(a) {
+					continue
+				}
+				run, _ := tagValue(s.Tags, tagRun)
+				key := a.String() + "@" + run
+				if run == "" {
+					key = a.String() + "#" + s.ID
+				}
+				e := runs[key]
+				if e == nil {
+					e = &listEntry{Host: a.Host, Container: a.Container, Time: s.Time, Run: run}
+					ee = append(ee, e)
+					runs[key] = e
+				}
+				if s.Time.Before(e.Time) {
+					e.Time = s.Time
+				}
+				if e.Size == 0 && s.Summary != nil {
+					e.Size = s.Summary.TotalBytesProcessed
+				}
+				if e.sizeID == "" {
+					e.sizeFrom, e.sizeID = r, s.ID
+				}
+				e.Snapshots = append(e.Snapshots, listSnapshot{ID: s.ShortID, Repo: r.Path})
+			}
+		}
+	}
+
+	for _, e := range ee {
+		if e.Size > 0 {
+			continue
+		}
+		size, err := e.sizeFrom.RestoreSize(ctx, e.sizeID)
+		if err != nil {
+			log.WithField("repo", e.sizeFrom.Path).Warnf("Cannot get the size of snapshot %s: %v", e.sizeID, err)
+			continue
+		}
+		e.Size = size
+	}
+
+	sort.Slice(ee, func(i, j int) bool {
+		if ee[i].Host != ee[j].Host {
+			return ee[i].Host < ee[j].Host
+		}
+		if ee[i].Container != ee[j].Container {
+			return ee[i].Container < ee[j].Container
+		}
+		return ee[i].Time.Before(ee[j].Time)
+	})
+
+	if config.JSON {
+		printListJSON(os.Stdout, ee)
+	} else {
+		printListTable(os.Stdout, ee)
+	}
+
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+func printListTable(out io.Writer, ee []*listEntry) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCONTAINER\tTIME\tSIZE\tID\tREPOS")
+	for _, e := range ee {
+		size := "-"
+		if e.Size > 0 {
+			size = formatBytes(e.Size)
+		}
+		var ids, repos []string
+		for _, s := range e.Snapshots {
+			ids = append(ids, s.ID)
+			repos = append(repos, s.Repo)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Host, e.Container, e.Time.Format(time.RFC3339), size, strings.Join(ids, ","), strings.Join(repos, ","))
+	}
+	w.Flush()
+}
+
+func printListJSON(out io.Writer, ee []*listEntry) {
+	if ee == nil {
+		ee = []*listEntry{}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(ee)
+	if err != nil {
+		log.Error(err)
+	}
+}
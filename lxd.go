@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Operation status codes as reported by LXD.
+const (
+	lxdSuccess = 200
+	lxdFailure = 400
+)
+
+// LXDRemote tells lxcer how to reach an LXD server. Addr is either
+// unix:// (optionally followed by the socket path) or https://host:port.
+// Remotes that are not listed in the config are looked up in the lxc CLI
+// configuration, the same way `lxc remote list` shows them.
+type LXDRemote struct {
+	Addr       string `yaml:"addr"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	ServerCert string `yaml:"server_cert"`
+}
+
+// LXDClient talks to the REST API of a single LXD server.
+type LXDClient struct {
+	Remote string
+	url    string
+	http   *http.Client
+
+	mu        sync.Mutex
+	instances string
+}
+
+// LXDError is returned when LXD rejects a request or a background
+// operation fails. StatusCode is the HTTP status of the request or the
+// status code of the failed operation.
+type LXDError struct {
+	Remote     string
+	Request    string
+	StatusCode int
+	Message    string
+}
+
+func (e *LXDError) Error() string {
+	return fmt.Sprintf("%s: %s: %s (%d)", e.Remote, e.Request, e.Message, e.StatusCode)
+}
+
+func isNotFound(err error) bool {
+	var e *LXDError
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+type lxdResponse struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status_code"`
+	ErrorCode  int             `json:"error_code"`
+	Error      string          `json:"error"`
+	Operation  string          `json:"operation"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type lxdOperation struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Err        string          `json:"err"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+var (
+	// lxdRemotes holds the remotes defined in the lxcer config.
+	lxdRemotes   map[string]LXDRemote
+	lxdClients   = make(map[string]*LXDClient)
+	lxdClientsMu sync.Mutex
+)
+
+// lxdClient returns a client for the named remote, creating it on first use.
+func lxdClient(remote string) (*LXDClient, error) {
+	lxdClientsMu.Lock()
+	defer lxdClientsMu.Unlock()
+
+	if l, ok := lxdClients[remote]; ok {
+		return l, nil
+	}
+	r, err := resolveRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	l, err := NewLXDClient(remote, r)
+	if err != nil {
+		return nil, err
+	}
+	lxdClients[remote] = l
+	return l, nil
+}
+
+func resolveRemote(name string) (LXDRemote, error) {
+	if r, ok := lxdRemotes[name]; ok {
+		return r, nil
+	}
+
+	var conf struct {
+		Remotes map[string]struct {
+			Addr string `yaml:"addr"`
+		} `yaml:"remotes"`
+	}
+	dir := lxcConfigDir()
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "config.yml"))
+	if err == nil {
+		err = yaml.Unmarshal(buf, &conf)
+		if err != nil {
+			return LXDRemote{}, fmt.Errorf("Error parsing lxc config: %s", err)
+		}
+	}
+
+	if rc, ok := conf.Remotes[name]; ok {
+		r := LXDRemote{Addr: rc.Addr}
+		if strings.HasPrefix(rc.Addr, "https://") {
+			r.ClientCert = filepath.Join(dir, "client.crt")
+			r.ClientKey = filepath.Join(dir, "client.key")
+			sc := filepath.Join(dir, "servercerts", name+".crt")
+			if _, err := os.Stat(sc); err == nil {
+				r.ServerCert = sc
+			}
+		}
+		return r, nil
+	}
+
+	if name == localHost {
+		return LXDRemote{Addr: "unix://"}, nil
+	}
+	return LXDRemote{}, fmt.Errorf("LXD remote %s is neither in lxcer nor in lxc config", name)
+}
+
+// lxcConfigDir finds the configuration directory of the lxc CLI.
+func lxcConfigDir() string {
+	if dir := os.Getenv("LXD_CONF"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	snap := filepath.Join(home, "snap", "lxd", "common", "config")
+	if _, err := os.Stat(snap); err == nil {
+		return snap
+	}
+	return filepath.Join(home, ".config", "lxc")
+}
+
+func defaultLXDSocket() string {
+	if dir := os.Getenv("LXD_DIR"); dir != "" {
+		return filepath.Join(dir, "unix.socket")
+	}
+	snap := "/var/snap/lxd/common/lxd/unix.socket"
+	if _, err := os.Stat(snap); err == nil {
+		return snap
+	}
+	return "/var/lib/lxd/unix.socket"
+}
+
+// NewLXDClient creates a client for the remote. Besides unix:// and
+// https:// addresses it accepts plain http://, which is only meant for
+// talking to a fake server in tests.
+func NewLXDClient(name string, r LXDRemote) (*LXDClient, error) {
+	l := &LXDClient{Remote: name}
+
+	switch {
+	case strings.HasPrefix(r.Addr, "unix://"):
+		socket := strings.TrimPrefix(r.Addr, "unix://")
+		if socket == "" {
+			socket = defaultLXDSocket()
+		}
+		l.url = "http://lxd"
+		l.http = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	case strings.HasPrefix(r.Addr, "https://"):
+		tlsConfig, err := r.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		l.url = strings.TrimSuffix(r.Addr, "/")
+		l.http = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}}
+	case strings.HasPrefix(r.Addr, "http://"):
+		l.url = strings.TrimSuffix(r.Addr, "/")
+		l.http = &http.Client{}
+	default:
+		return nil, fmt.Errorf("Unsupported address %q for LXD remote %s", r.Addr, name)
+	}
+	return l, nil
+}
+
+// tlsConfig authenticates with the client certificate. LXD servers use
+// self-signed certificates, so when the server certificate is known it is
+// pinned instead of being verified against the system roots.
+func (r LXDRemote) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if r.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if r.ServerCert != "" {
+		buf, err := ioutil.ReadFile(r.ServerCert)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in %s", r.ServerCert)
+		}
+		pinned, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned.Raw) {
+				return fmt.Errorf("Server certificate does not match %s", r.ServerCert)
+			}
+			return nil
+		}
+	}
+	return c, nil
+}
+
+type header struct {
+	key   string
+	value string
+}
+
+// do sends a request and returns the raw response. body is sent as is when
+// it is an io.Reader and JSON encoded otherwise. The request is aborted
+// once ctx is done.
+func (l *LXDClient) do(ctx context.Context, method, path string, body interface{}, headers ...header) (*http.Response, error) {
+	var (
+		r           io.Reader
+		contentType string
+	)
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+		contentType = "application/octet-stream"
+	default:
+		buf, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(buf)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, l.url+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, h := range headers {
+		req.Header.Set(h.key, h.value)
+	}
+	if f, ok := body.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			req.ContentLength = fi.Size()
+		}
+	}
+	return l.http.Do(req)
+}
+
+// query sends a request and waits for the background operation it started,
+// if any. It returns the metadata of the response or of the operation.
+func (l *LXDClient) query(ctx context.Context, method, path string, body interface{}, headers ...header) (json.RawMessage, error) {
+	request := method + " " + path
+
+	resp, err := l.do(ctx, method, path, body, headers...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	r, err := l.decode(request, resp)
+	if err != nil {
+		return nil, err
+	}
+	if r.Type == "async" {
+		return l.wait(ctx, request, r.Operation)
+	}
+	return r.Metadata, nil
+}
+
+func (l *LXDClient) decode(request string, resp *http.Response) (*lxdResponse, error) {
+	var r lxdResponse
+	err := json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		if resp.StatusCode >= 300 {
+			return nil, &LXDError{Remote: l.Remote, Request: request, StatusCode: resp.StatusCode, Message: resp.Status}
+		}
+		return nil, fmt.Errorf("%s: %s: %s", l.Remote, request, err)
+	}
+	if r.Type == "error" || resp.StatusCode >= 300 {
+		code := r.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return nil, &LXDError{Remote: l.Remote, Request: request, StatusCode: code, Message: r.Error}
+	}
+	return &r, nil
+}
+
+// wait polls the operation until it is done. Once ctx is done the
+// operation is cancelled, as far as LXD allows.
+func (l *LXDClient) wait(ctx context.Context, request, op string) (json.RawMessage, error) {
+	for {
+		meta, err := l.query(ctx, "GET", op+"/wait?timeout=30", nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				cctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				l.query(cctx, "DELETE", op, nil)
+				cancel()
+			}
+			return nil, err
+		}
+		var o lxdOperation
+		err = json.Unmarshal(meta, &o)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case o.StatusCode == lxdSuccess:
+			return o.Metadata, nil
+		case o.StatusCode >= lxdFailure:
+			return nil, &LXDError{Remote: l.Remote, Request: request, StatusCode: o.StatusCode, Message: o.Err}
+		}
+	}
+}
+
+// instancesPath is where the server keeps containers and virtual machines.
+// LXD before 3.19 has no /1.0/instances and only knows containers.
+func (l *LXDClient) instancesPath(ctx context.Context) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.instances != "" {
+		return l.instances, nil
+	}
+
+	meta, err := l.query(ctx, "GET", "/1.0", nil)
+	if err != nil {
+		return "", err
+	}
+	var server struct {
+		APIExtensions []string `json:"api_extensions"`
+	}
+	err = json.Unmarshal(meta, &server)
+	if err != nil {
+		return "", err
+	}
+	l.instances = "/1.0/containers"
+	if contains(server.APIExtensions, "instances") {
+		l.instances = "/1.0/instances"
+	}
+	return l.instances, nil
+}
+
+// instancePath is the path of instance name, followed by sub.
+func (l *LXDClient) instancePath(ctx context.Context, name string, sub ...string) (string, error) {
+	path, err := l.instancesPath(ctx)
+	if err != nil {
+		return "", err
+	}
+	path += "/" + url.PathEscape(name)
+	for _, s := range sub {
+		path += "/" + url.PathEscape(s)
+	}
+	return path, nil
+}
+
+// Containers lists the containers and, on LXD with instances, the virtual
+// machines of the server.
+func (l *LXDClient) Containers(ctx context.Context) ([]Container, error) {
+	path, err := l.instancesPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := l.query(ctx, "GET", path+"?recursion=2", nil)
+	if err != nil {
+		return nil, err
+	}
+	var cc []Container
+	err = json.Unmarshal(meta, &cc)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cc {
+		// Older LXD reports snapshots as container/snapshot
+		for j, s := range cc[i].Snapshots {
+			cc[i].Snapshots[j].Name = s.Name[strings.LastIndex(s.Name, "/")+1:]
+		}
+	}
+	return cc, nil
+}
+
+// DeleteContainer removes the container, stopping it first if needed.
+func (l *LXDClient) DeleteContainer(ctx context.Context, name string) error {
+	path, err := l.instancePath(ctx, name)
+	if err != nil {
+		return err
+	}
+	meta, err := l.query(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	var c Container
+	err = json.Unmarshal(meta, &c)
+	if err != nil {
+		return err
+	}
+	if c.StatusCode == StatusRunning {
+		_, err = l.query(ctx, "PUT", path+"/state", map[string]interface{}{
+			"action":  "stop",
+			"force":   true,
+			"timeout": -1,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = l.query(ctx, "DELETE", path, nil)
+	return err
+}
+
+// CreateContainer creates an instance of type typ out of the image alias.
+// LXD takes an instance without a type for a container.
+func (l *LXDClient) CreateContainer(ctx context.Context, name, alias, typ string) error {
+	path, err := l.instancesPath(ctx)
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{
+		"name": name,
+		"source": map[string]string{
+			"type":  "image",
+			"alias": alias,
+		},
+	}
+	if typ != "" {
+		req["type"] = typ
+	}
+	_, err = l.query(ctx, "POST", path, req)
+	return err
+}
+
+func (l *LXDClient) StartContainer(ctx context.Context, name string) error {
+	path, err := l.instancePath(ctx, name, "state")
+	if err != nil {
+		return err
+	}
+	_, err = l.query(ctx, "PUT", path, map[string]interface{}{
+		"action":  "start",
+		"timeout": -1,
+	})
+	return err
+}
+
+func (l *LXDClient) CreateSnapshot(ctx context.Context, container, name string) error {
+	path, err := l.instancePath(ctx, container, "snapshots")
+	if err != nil {
+		return err
+	}
+	_, err = l.query(ctx, "POST", path, map[string]interface{}{
+		"name":     name,
+		"stateful": false,
+	})
+	return err
+}
+
+func (l *LXDClient) DeleteSnapshot(ctx context.Context, container, name string) error {
+	path, err := l.instancePath(ctx, container, "snapshots", name)
+	if err != nil {
+		return err
+	}
+	_, err = l.query(ctx, "DELETE", path, nil)
+	return err
+}
+
+// Publish creates an uncompressed image out of a container snapshot and
+// returns its fingerprint.
+func (l *LXDClient) Publish(ctx context.Context, container, snapshot, alias string, properties map[string]string) (string, error) {
+	meta, err := l.query(ctx, "POST", "/1.0/images", map[string]interface{}{
+		"source": map[string]string{
+			"type": "snapshot",
+			"name": container + "/" + snapshot,
+		},
+		"aliases": []map[string]string{
+			{"name": alias},
+		},
+		"properties":            properties,
+		"compression_algorithm": "none",
+	})
+	if err != nil {
+		return "", err
+	}
+	var m struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	err = json.Unmarshal(meta, &m)
+	return m.Fingerprint, err
+}
+
+func (l *LXDClient) Images(ctx context.Context) ([]Image, error) {
+	meta, err := l.query(ctx, "GET", "/1.0/images?recursion=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	err = json.Unmarshal(meta, &images)
+	return images, err
+}
+
+// Image returns the image behind alias.
+func (l *LXDClient) Image(ctx context.Context, alias string) (Image, error) {
+	var i Image
+	fp, err := l.ImageFingerprint(ctx, alias)
+	if err != nil {
+		return i, err
+	}
+	meta, err := l.query(ctx, "GET", "/1.0/images/"+url.PathEscape(fp), nil)
+	if err != nil {
+		return i, err
+	}
+	err = json.Unmarshal(meta, &i)
+	return i, err
+}
+
+// ImageFingerprint resolves an image alias.
+func (l *LXDClient) ImageFingerprint(ctx context.Context, alias string) (string, error) {
+	meta, err := l.query(ctx, "GET", "/1.0/images/aliases/"+url.PathEscape(alias), nil)
+	if err != nil {
+		return "", err
+	}
+	var a struct {
+		Target string `json:"target"`
+	}
+	err = json.Unmarshal(meta, &a)
+	return a.Target, err
+}
+
+// ExportImage writes the unified tarball of the image behind alias to w.
+func (l *LXDClient) ExportImage(ctx context.Context, alias string, w io.Writer) error {
+	fp, err := l.ImageFingerprint(ctx, alias)
+	if err != nil {
+		return err
+	}
+
+	path := "/1.0/images/" + fp + "/export"
+	resp, err := l.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, err = l.decode("GET "+path, resp)
+		return err
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/") {
+		return fmt.Errorf("%s: image %s is split into several files, only unified images are supported", l.Remote, alias)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// ImportImage uploads a unified image tarball with the given properties and
+// assigns alias to it.
+func (l *LXDClient) ImportImage(ctx context.Context, r io.Reader, alias string, properties map[string]string) (string, error) {
+	props := url.Values{}
+	for k, v := range properties {
+		props.Set(k, v)
+	}
+	meta, err := l.query(ctx, "POST", "/1.0/images", r, header{"X-LXD-properties", props.Encode()})
+	if err != nil {
+		return "", err
+	}
+	var m struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	err = json.Unmarshal(meta, &m)
+	if err != nil {
+		return "", err
+	}
+	_, err = l.query(ctx, "POST", "/1.0/images/aliases", map[string]string{
+		"name":   alias,
+		"target": m.Fingerprint,
+	})
+	if err != nil {
+		// Don't leave an image behind that nobody can find by alias
+		l.DeleteImage(context.Background(), m.Fingerprint)
+		return "", err
+	}
+	return m.Fingerprint, nil
+}
+
+func (l *LXDClient) DeleteImage(ctx context.Context, fingerprint string) error {
+	_, err := l.query(ctx, "DELETE", "/1.0/images/"+url.PathEscape(fingerprint), nil)
+	return err
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// fakeLXD is a local stand-in for the LXD REST API. Handlers are keyed by
+// "METHOD path", every request that came in is kept.
+type fakeLXD struct {
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []string
+}
+
+func newFakeLXD(t *testing.T) (*fakeLXD, *LXDClient) {
+	f := &fakeLXD{handlers: map[string]http.HandlerFunc{
+		"GET /1.0": lxdSync(map[string]interface{}{"api_extensions": []string{"instances"}}),
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	l, err := NewLXDClient("fake", LXDRemote{Addr: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, l
+}
+
+// useLXD makes l the client of LXD remote host for the test.
+func useLXD(t *testing.T, host string, l *LXDClient) {
+	lxdClientsMu.Lock()
+	lxdClients[host] = l
+	lxdClientsMu.Unlock()
+	t.Cleanup(func() {
+		lxdClientsMu.Lock()
+		delete(lxdClients, host)
+		lxdClientsMu.Unlock()
+	})
+}
+
+func (f *fakeLXD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	f.mu.Lock()
+	f.requests = append(f.requests, key)
+	h, ok := f.handlers[key]
+	f.mu.Unlock()
+	if !ok {
+		lxdReply(w, http.StatusNotFound, map[string]interface{}{
+			"type": "error", "error": "not found", "error_code": 404,
+		})
+		return
+	}
+	h(w, r)
+}
+
+func (f *fakeLXD) handle(key string, h http.HandlerFunc) {
+	f.handlers[key] = h
+}
+
+func (f *fakeLXD) requested(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if r == key {
+			return true
+		}
+	}
+	return false
+}
+
+func lxdReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func lxdSync(metadata interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lxdReply(w, http.StatusOK, map[string]interface{}{
+			"type": "sync", "status_code": 200, "metadata": metadata,
+		})
+	}
+}
+
+func lxdAsync(op string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lxdReply(w, http.StatusAccepted, map[string]interface{}{
+			"type": "async", "status_code": 100, "operation": op,
+		})
+	}
+}
+
+// lxdOperationDone answers the wait of an operation that ended with status
+// and err.
+func lxdOperationDone(status int, err string, metadata interface{}) http.HandlerFunc {
+	return lxdSync(map[string]interface{}{
+		"id": "op", "status_code": status, "err": err, "metadata": metadata,
+	})
+}
+
+func TestLXDSync(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("GET /1.0/instances", lxdSync([]map[string]interface{}{
+		{"name": "c1", "status_code": 103, "type": "virtual-machine", "architecture": "x86_64",
+			"snapshots": []map[string]string{{"name": "c1/lxcer-1"}}},
+	}))
+
+	cc, err := l.Containers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc) != 1 || cc[0].Name != "c1" || cc[0].StatusCode != StatusRunning || cc[0].Architecture != "x86_64" {
+		t.Fatalf("containers = %+v", cc)
+	}
+	if cc[0].instanceType() != "virtual-machine" {
+		t.Errorf("type = %q, want virtual-machine", cc[0].instanceType())
+	}
+	// Older LXD reports snapshots as container/snapshot
+	if cc[0].Snapshots[0].Name != "lxcer-1" {
+		t.Errorf("snapshot = %q, want lxcer-1", cc[0].Snapshots[0].Name)
+	}
+}
+
+func TestLXDWithoutInstances(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("GET /1.0", lxdSync(map[string]interface{}{"api_extensions": []string{"storage"}}))
+	f.handle("GET /1.0/containers", lxdSync([]map[string]interface{}{{"name": "c1"}}))
+	f.handle("POST /1.0/containers/c1/snapshots", lxdSync(nil))
+
+	cc, err := l.Containers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc) != 1 || cc[0].instanceType() != "container" {
+		t.Errorf("containers = %+v", cc)
+	}
+	err = l.CreateSnapshot(context.Background(), "c1", "lxcer-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLXDAsync(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("POST /1.0/instances/c1/snapshots", lxdAsync("/1.0/operations/op1"))
+	f.handle("GET /1.0/operations/op1/wait", lxdOperationDone(lxdSuccess, "", nil))
+
+	err := l.CreateSnapshot(context.Background(), "c1", "lxcer-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.requested("GET /1.0/operations/op1/wait") {
+		t.Error("operation was not waited for")
+	}
+}
+
+func TestLXDFailedOperation(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("POST /1.0/images", lxdAsync("/1.0/operations/op1"))
+	f.handle("GET /1.0/operations/op1/wait", lxdOperationDone(lxdFailure, "Failed to publish", nil))
+
+	_, err := l.Publish(context.Background(), "c1", "lxcer-1", "alias", nil)
+	var e *LXDError
+	if !errors.As(err, &e) {
+		t.Fatalf("err = %v, want an LXDError", err)
+	}
+	if e.StatusCode != lxdFailure || e.Message != "Failed to publish" || e.Remote != "fake" {
+		t.Errorf("err = %+v", e)
+	}
+}
+
+func TestLXDErrorStatus(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("GET /1.0/images/aliases/busy", func(w http.ResponseWriter, r *http.Request) {
+		// A proxy in front of LXD answers without JSON
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html>unavailable</html>"))
+	})
+	f.handle("GET /1.0/images/aliases/forbidden", func(w http.ResponseWriter, r *http.Request) {
+		lxdReply(w, http.StatusForbidden, map[string]interface{}{
+			"type": "error", "error": "not authorized", "error_code": 403,
+		})
+	})
+
+	tests := []struct {
+		alias     string
+		status    int
+		notFound  bool
+		transient bool
+	}{
+		{alias: "missing", status: http.StatusNotFound, notFound: true},
+		{alias: "busy", status: http.StatusServiceUnavailable, transient: true},
+		{alias: "forbidden", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			_, err := l.ImageFingerprint(context.Background(), tt.alias)
+			var e *LXDError
+			if !errors.As(err, &e) {
+				t.Fatalf("err = %v, want an LXDError", err)
+			}
+			if e.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", e.StatusCode, tt.status)
+			}
+			if isNotFound(err) != tt.notFound {
+				t.Errorf("isNotFound = %v, want %v", isNotFound(err), tt.notFound)
+			}
+			if transient(err) != tt.transient {
+				t.Errorf("transient = %v, want %v", transient(err), tt.transient)
+			}
+		})
+	}
+}
+
+func TestLXDExportImage(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("GET /1.0/images/aliases/a1", lxdSync(map[string]string{"target": "fp1"}))
+	f.handle("GET /1.0/images/fp1/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("tarball"))
+	})
+	f.handle("GET /1.0/images/aliases/split", lxdSync(map[string]string{"target": "fp2"}))
+	f.handle("GET /1.0/images/fp2/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/form-data; boundary=x")
+		w.Write([]byte("--x--"))
+	})
+
+	var buf bytes.Buffer
+	err := l.ExportImage(context.Background(), "a1", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "tarball" {
+		t.Errorf("export = %q, want tarball", buf.String())
+	}
+
+	err = l.ExportImage(context.Background(), "split", &buf)
+	if err == nil {
+		t.Error("split image was exported")
+	}
+	err = l.ExportImage(context.Background(), "missing", &buf)
+	if !isNotFound(err) {
+		t.Errorf("err = %v, want not found", err)
+	}
+}
+
+func TestLXDImportImage(t *testing.T) {
+	f, l := newFakeLXD(t)
+	var (
+		body  []byte
+		props url.Values
+		alias map[string]string
+	)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		props, _ = url.ParseQuery(r.Header.Get("X-LXD-properties"))
+		lxdAsync("/1.0/operations/op1")(w, r)
+	})
+	f.handle("GET /1.0/operations/op1/wait", lxdOperationDone(lxdSuccess, "", map[string]string{"fingerprint": "fp1"}))
+	f.handle("POST /1.0/images/aliases", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&alias)
+		lxdSync(nil)(w, r)
+	})
+
+	fp, err := l.ImportImage(context.Background(), bytes.NewReader([]byte("tarball")), "a1", map[string]string{runProperty: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != "fp1" {
+		t.Errorf("fingerprint = %q, want fp1", fp)
+	}
+	if string(body) != "tarball" {
+		t.Errorf("uploaded %q, want tarball", body)
+	}
+	if props.Get(runProperty) != "r1" {
+		t.Errorf("properties = %v", props)
+	}
+	if alias["name"] != "a1" || alias["target"] != "fp1" {
+		t.Errorf("alias = %v", alias)
+	}
+}
+
+func TestLXDImportImageAliasFails(t *testing.T) {
+	f, l := newFakeLXD(t)
+	f.handle("POST /1.0/images", lxdAsync("/1.0/operations/op1"))
+	f.handle("GET /1.0/operations/op1/wait", lxdOperationDone(lxdSuccess, "", map[string]string{"fingerprint": "fp1"}))
+	f.handle("POST /1.0/images/aliases", func(w http.ResponseWriter, r *http.Request) {
+		lxdReply(w, http.StatusConflict, map[string]interface{}{
+			"type": "error", "error": "Alias already exists", "error_code": 409,
+		})
+	})
+	f.handle("DELETE /1.0/images/fp1", lxdSync(nil))
+
+	_, err := l.ImportImage(context.Background(), bytes.NewReader(nil), "a1", nil)
+	if err == nil {
+		t.Fatal("import succeeded without an alias")
+	}
+	if !f.requested("DELETE /1.0/images/fp1") {
+		t.Error("image without alias was left behind")
+	}
+}
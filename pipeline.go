@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stage is a single step of the backup pipeline. Do is applied to every
+// container that made it through the previous stages. A container for which
+// Do fails is dropped from the pipeline unless ContinueOnError is set. Either
+// way the container counts as failed in the report, unless Retry is set and
+// the pipeline has retries left: then it goes through all stages again.
+// Transient errors of Do are retried right away by Policy. Every attempt
+// is given Timeout, after which its context is done and whatever Do is
+// running gets killed. Containers Skip returns true for pass the stage
+// untouched.
+type Stage struct {
+	Name            string
+	Workers         int
+	ContinueOnError bool
+	Retry           bool
+	Policy          RetryPolicy
+	Timeout         time.Duration
+	Skip            func(c *Container) bool
+	Do              func(ctx context.Context, c *Container) error
+}
+
+// Pipeline takes containers through an ordered list of stages. The same
+// stages are used whether containers are processed one by one or
+// concurrently, local or remote. The outcome of every container is added
+// to Report.
+type Pipeline struct {
+	Stages  []Stage
+	Report  *Report
+	Retries int
+
+	// head and pending let Concurrent feed retried containers back in
+	head    chan *job
+	pending sync.WaitGroup
+}
+
+// backupPipeline builds the snapshot -> publish -> export -> compress ->
+// upload sequence. In stream mode export, compression and upload are a
+// single stage with no files in between. With replication the archive is
+// uploaded to the primary repo only and copied to the others at the end.
+// Last, containers that missed the repo quorum are failed and retried,
+// straight to replication when the upload repos have them already.
+// Uploads and copies share the global upload limit.
+// hostWorkers is the number of containers that are snapshotted and
+// published at the same time.
+func backupPipeline(config *Config, hostWorkers int) *Pipeline {
+	p := &Pipeline{}
+	p.Stages = append(p.Stages, Stage{
+		Name:    "Publish snapshot as image",
+		Workers: hostWorkers,
+		Policy:  config.retryPolicy("publish"),
+		Timeout: config.stageTimeout("publish"),
+		Do:      publishStage,
+	})
+
+	bw := newBandwidth(config.LimitUpload, uploadSlots(config))
+	repos := config.uploadRepos()
+	if config.Stream {
+		p.Stages = append(p.Stages,
+			Stage{
+				Name:            "Stream image through zstd to restic repos",
+				Workers:         config.LocalWorkers,
+				ContinueOnError: true,
+				Do:              streamStage(repos, bw, config.retryPolicy("stream"), config.stageTimeout("stream")),
+			},
+			Stage{
+				Name:    "Delete image",
+				Workers: config.LocalWorkers,
+				Policy:  config.retryPolicy("delete"),
+				Timeout: config.stageTimeout("delete"),
+				Do: func(ctx context.Context, c *Container) error {
+					return c.DeleteImage(ctx)
+				},
+			},
+		)
+	} else {
+		p.Stages = append(p.Stages,
+			Stage{
+				Name:    "Export image as .tar",
+				Workers: config.LocalWorkers,
+				Policy:  config.retryPolicy("export"),
+				Timeout: config.stageTimeout("export"),
+				Do:      exportStage,
+			},
+			Stage{
+				Name:    "Compress .tar to .tar.zst",
+				Workers: config.LocalWorkers,
+				Policy:  config.retryPolicy("compress"),
+				Timeout: config.stageTimeout("compress"),
+				Do:      compressStage,
+			},
+			uploadStage(repos, bw, config.retryPolicy("upload"), config.stageTimeout("upload")),
+			Stage{Name: "Delete .tar.zst", Workers: 1, Do: func(_ context.Context, c *Container) error {
+				return DeleteImageTarZst(c.archive())
+			}},
+		)
+	}
+	// A container retried only for its replicas has nothing to upload
+	for i := range p.Stages {
+		p.Stages[i].Skip = func(c *Container) bool {
+			return len(c.missing(repos)) == 0
+		}
+	}
+
+	if replicas := config.replicaRepos(); len(replicas) > 0 {
+		p.Stages = append(p.Stages, replicateStage(repos[0], replicas, bw, config.retryPolicy("copy"), config.stageTimeout("copy")))
+	}
+	p.Stages = append(p.Stages, quorumStage(config.Quorum, config.BackupResticRepos))
+	p.Retries = config.Quorum.Retries
+	return p
+}
+
+// publishStage snapshots the container under the name of this run and
+// publishes the snapshot as an image. The snapshot is removed either way,
+// even when ctx is done already.
+func publishStage(ctx context.Context, c *Container) error {
+	sn := runSnapshot()
+	err := c.CreateSnapshot(ctx, sn)
+	if err != nil {
+		return err
+	}
+	err = c.PublishSnapshot(ctx, sn)
+	if err != nil {
+		if derr := c.DeleteSnapshot(context.Background(), sn); derr != nil {
+			log.WithField("container", c.Name).Error(derr)
+		}
+		return err
+	}
+	return c.DeleteSnapshot(ctx, sn)
+}
+
+func exportStage(ctx context.Context, c *Container) error {
+	err := c.ExportImage(ctx)
+	if err != nil {
+		return err
+	}
+	return c.DeleteImage(ctx)
+}
+
+func compressStage(ctx context.Context, c *Container) error {
+	err := c.CompressWithZst(ctx)
+	if err != nil {
+		return err
+	}
+	return DeleteImageTar(c.archive())
+}
+
+// streamStage streams the image to the repos the container is still
+// missing. A broken export and repos that failed with a transient error
+// are streamed again by policy, every attempt is given timeout. Like with
+// uploads, repos that still failed are left to the quorum unless no repo
+// was reached at all. Every attempt takes its share of bw for the repos
+// before the export starts.
+func streamStage(repos []ResticRepo, bw *bandwidth, policy RetryPolicy, timeout time.Duration) func(ctx context.Context, c *Container) error {
+	return func(ctx context.Context, c *Container) error {
+		log := log.WithFields(log.Fields{
+			"host":      c.Host,
+			"container": c.Name,
+		})
+		retries, err := policy.do(ctx, log, "Stream to restic repos", func() error {
+			missing := c.missing(repos)
+			if len(missing) == 0 {
+				return nil
+			}
+			c.UploadErrors = nil
+			missing, release, err := bw.limit(ctx, missing)
+			if err != nil {
+				return err
+			}
+			defer release()
+			return withTimeout(ctx, timeout, func(ctx context.Context) error {
+				return c.StreamToRepos(ctx, missing)
+			})
+		})
+		c.Retries = append(c.Retries, retries...)
+		var re *repoErrors
+		if errors.As(err, &re) && len(c.missing(repos)) < len(repos) {
+			return nil
+		}
+		return err
+	}
+}
+
+// uploadStage pushes the archive to all repos at once. The stage is done
+// with a container once every repo reported back. A failed upload does not
+// stop the container from reaching the other repos, the quorum stage
+// decides whether it matters.
+func uploadStage(repos []ResticRepo, bw *bandwidth, policy RetryPolicy, timeout time.Duration) Stage {
+	f := newRepoFanOut(repos, bw, policy, timeout)
+	return Stage{
+		Name:            "Backup .tar.zst to restic repos",
+		Workers:         f.workers(),
+		ContinueOnError: true,
+		Do: func(ctx context.Context, c *Container) error {
+			a := c.archive()
+			f.run(ctx, c, "Backup .tar.zst to", func(ctx context.Context, r ResticRepo) (backupSummary, error) {
+				return r.Backup(ctx, a)
+			})
+			return nil
+		},
+	}
+}
+
+// repoFanOut does the same for a container in several repos at once. Every
+// repo has its own pool of workers, so a slow repo only holds back its own
+// queue. Every repo retries its own transient errors by policy, every
+// attempt takes its share of bw and is given timeout.
+type repoFanOut struct {
+	repos   []ResticRepo
+	pools   []chan struct{}
+	bw      *bandwidth
+	policy  RetryPolicy
+	timeout time.Duration
+}
+
+func newRepoFanOut(repos []ResticRepo, bw *bandwidth, policy RetryPolicy, timeout time.Duration) *repoFanOut {
+	f := &repoFanOut{repos: repos, bw: bw, policy: policy, timeout: timeout}
+	for _, r := range repos {
+		f.pools = append(f.pools, make(chan struct{}, r.workers()))
+	}
+	return f
+}
+
+// workers is how many containers the repos take at once all together.
+func (f *repoFanOut) workers() int {
+	n := 0
+	for _, r := range f.repos {
+		n += r.workers()
+	}
+	return n
+}
+
+// run calls do for every repo the container was not uploaded to yet and
+// waits for all of them. The retries and the outcome of every repo are
+// recorded in c.
+func (f *repoFanOut) run(ctx context.Context, c *Container, what string, do func(ctx context.Context, r ResticRepo) (backupSummary, error)) {
+	var todo []int
+	for i, r := range f.repos {
+		if !c.uploaded(r) {
+			todo = append(todo, i)
+		}
+	}
+	var (
+		wg      sync.WaitGroup
+		repos   = make([]ResticRepo, len(todo))
+		sums    = make([]backupSummary, len(todo))
+		errs    = make([]error, len(todo))
+		retries = make([][]string, len(todo))
+	)
+	for k, i := range todo {
+		repos[k] = f.repos[i]
+		wg.Add(1)
+		go func(k, i int, r ResticRepo) {
+			defer wg.Done()
+			f.pools[i] <- struct{}{}
+			defer func() { <-f.pools[i] }()
+			log := log.WithFields(log.Fields{
+				"host":      c.Host,
+				"container": c.Name,
+				"repo":      r.Path,
+			})
+			t := time.Now()
+			retries[k], errs[k] = f.policy.do(ctx, log, what+" "+r.Path, func() error {
+				limited, release, err := f.bw.limit(ctx, []ResticRepo{r})
+				if err != nil {
+					return err
+				}
+				defer release()
+				return withTimeout(ctx, f.timeout, func(ctx context.Context) error {
+					var err error
+					sums[k], err = do(ctx, limited[0])
+					return err
+				})
+			})
+			if errs[k] == nil {
+				log.WithField("spent", time.Since(t)).Infof("%s %s", what, r.Path)
+			}
+		}(k, i, f.repos[i])
+	}
+	wg.Wait()
+	for _, rr := range retries {
+		c.Retries = append(c.Retries, rr...)
+	}
+	c.recordUploads(repos, sums, errs)
+}
+
+// job is a container on its way through the pipeline.
+type job struct {
+	c       Container
+	src     Container
+	start   time.Time
+	errors  []string
+	attempt int
+	retry   bool
+}
+
+func newJob(c Container) *job {
+	return &job{c: c, src: c, start: time.Now()}
+}
+
+// again starts the container over, the time spent, the retries and the
+// uploads that made it keep adding up.
+func (j *job) again() *job {
+	c := j.src
+	c.Retries = append(j.c.Retries, strings.Join(j.errors, "; "))
+	c.Uploads = j.c.Uploads
+	return &job{c: c, src: j.src, start: j.start, attempt: j.attempt + 1}
+}
+
+// shouldRetry tells whether the job failed a stage that allows a retry and
+// has attempts left.
+func (p *Pipeline) shouldRetry(j *job) bool {
+	if !j.retry || j.attempt >= p.Retries || interrupted() {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"host":      j.c.Host,
+		"container": j.c.Name,
+		"attempt":   j.attempt + 2,
+	}).Warnf("Retrying: %s", strings.Join(j.errors, "; "))
+	return true
+}
+
+// finish records the outcome of the job once it left the pipeline, either
+// at the end or after a failed stage.
+func (p *Pipeline) finish(j *job) {
+	if p.Report == nil {
+		return
+	}
+	p.Report.Add(Result{
+		Host:      j.c.Host,
+		Container: j.c.Name,
+		Errors:    j.errors,
+		Warnings:  j.c.UploadErrors,
+		Retries:   j.c.Retries,
+		Uploads:   j.c.Uploads,
+		Spent:     time.Since(j.start),
+	})
+}
+
+// skip records a container that was not backed up because lxcer was
+// asked to stop.
+func (p *Pipeline) skip(c Container) {
+	if p.Report == nil {
+		return
+	}
+	p.Report.Add(Result{
+		Host:      c.Host,
+		Container: c.Name,
+		Errors:    []string{"Not started, lxcer was interrupted"},
+	})
+}
+
+// Sequential takes every container through all stages before moving on to
+// the next one. Once lxcer is asked to stop, the rest are skipped.
+func (p *Pipeline) Sequential(ctx context.Context, cc []Container) {
+	for _, c := range cc {
+		if interrupted() {
+			p.skip(c)
+			continue
+		}
+		j := newJob(c)
+		for {
+			for _, s := range p.Stages {
+				if !s.run(ctx, j) {
+					break
+				}
+			}
+			if !p.shouldRetry(j) {
+				break
+			}
+			j = j.again()
+		}
+		p.finish(j)
+	}
+}
+
+// Concurrent chains the stages with channels so that each stage works on
+// its own container, with up to Workers containers per stage. It returns
+// once src is closed and every container has left the pipeline. Once lxcer
+// is asked to stop, the containers still to come from src are skipped.
+func (p *Pipeline) Concurrent(ctx context.Context, src chan Container) {
+	p.head = make(chan *job)
+	go func() {
+		for c := range src {
+			if interrupted() {
+				p.skip(c)
+				continue
+			}
+			p.pending.Add(1)
+			select {
+			case p.head <- newJob(c):
+			case <-stopping:
+				p.skip(c)
+				p.pending.Done()
+			}
+		}
+		// Retried containers are still on their way
+		p.pending.Wait()
+		close(p.head)
+	}()
+
+	ch := p.head
+	for _, s := range p.Stages {
+		ch = p.start(ctx, s, ch)
+	}
+	for j := range ch {
+		p.done(j)
+	}
+}
+
+// done feeds a job that left the concurrent pipeline back in if it is to
+// be retried and records its outcome otherwise.
+func (p *Pipeline) done(j *job) {
+	if p.shouldRetry(j) {
+		// Not from this goroutine, the head may be waiting on the tail
+		go func(j *job) { p.head <- j }(j.again())
+		return
+	}
+	p.finish(j)
+	p.pending.Done()
+}
+
+// run applies the stage to the job's container and reports whether it
+// should move on.
+func (s Stage) run(ctx context.Context, j *job) bool {
+	if s.Skip != nil && s.Skip(&j.c) {
+		return true
+	}
+	log := log.WithFields(log.Fields{
+		"host":      j.c.Host,
+		"container": j.c.Name,
+	})
+	t := time.Now()
+	retries, err := s.Policy.do(ctx, log, s.Name, func() error {
+		return withTimeout(ctx, s.Timeout, func(ctx context.Context) error {
+			return s.Do(ctx, &j.c)
+		})
+	})
+	j.c.Retries = append(j.c.Retries, retries...)
+	if err != nil {
+		log.WithField("stage", s.Name).Error(err)
+		j.errors = append(j.errors, fmt.Sprintf("%s: %v", s.Name, err))
+		j.retry = j.retry || s.Retry
+		return s.ContinueOnError
+	}
+	log.WithField("spent", time.Since(t)).Info(s.Name)
+	return true
+}
+
+func (p *Pipeline) start(ctx context.Context, s Stage, ch chan *job) chan *job {
+	w := s.Workers
+	if w < 1 {
+		w = 1
+	}
+	nextChan := make(chan *job, w)
+
+	go func() {
+		wg := sync.WaitGroup{}
+		for i := 0; i < w; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range ch {
+					if s.run(ctx, j) {
+						nextChan <- j
+					} else {
+						p.done(j)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(nextChan)
+	}()
+
+	return nextChan
+}
+
+// stageTimeout is the timeout of the stage with the given key: the same
+// keys as for the retry policy, list for listing the containers of a host,
+// and dump, decompress, import and start for the steps of a restore.
+func (c *Config) stageTimeout(stage string) time.Duration {
+	if d, ok := c.StageTimeout[stage]; ok {
+		return d
+	}
+	return c.Timeout
+}
+
+// withTimeout runs f with a context that is done after d, unless d is 0.
+// An error that came of the deadline says so.
+func withTimeout(ctx context.Context, d time.Duration, f func(ctx context.Context) error) error {
+	if d <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err := f(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out after %s: %w", d, err)
+	}
+	return err
+}
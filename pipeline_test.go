@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRetryUploadsOnlyMissingRepos(t *testing.T) {
+	failed := false
+	f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+		if repoOf(c) == "two" && !failed {
+			failed = true
+			return nil, errors.New("Fatal: unable to open repository")
+		}
+		return []byte(`{"message_type":"summary","snapshot_id":"0123456789abcdef"}`), nil
+	}}
+	useRunner(t, f)
+
+	repos := []ResticRepo{{Path: "one"}, {Path: "two"}}
+	report := &Report{}
+	p := &Pipeline{
+		Stages:  []Stage{uploadStage(repos, nil, RetryPolicy{Attempts: 1}, 0), quorumStage(Quorum{}, repos)},
+		Report:  report,
+		Retries: 1,
+	}
+	p.Sequential(context.Background(), []Container{{Name: "c1", Host: "h1"}})
+
+	var tried []string
+	for _, c := range f.commands {
+		tried = append(tried, repoOf(c))
+	}
+	if !reflect.DeepEqual(tried, []string{"one", "two", "two"}) && !reflect.DeepEqual(tried, []string{"two", "one", "two"}) {
+		t.Errorf("uploaded to %q, want one and two, then two again", tried)
+	}
+	res := report.Results[0]
+	if !res.OK() || len(res.Uploads) != 2 || len(res.Retries) != 1 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestRetryOnlyReplicas(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	c := Container{Name: "c1", Host: "h1"}
+	f.handle("POST /1.0/instances/c1/snapshots", lxdSync(nil))
+	f.handle("DELETE /1.0/instances/c1/snapshots/"+runSnapshot(), lxdSync(nil))
+	f.handle("POST /1.0/images", lxdSync(map[string]string{"fingerprint": "fp1"}))
+	f.handle("GET /1.0/images/aliases/"+c.alias(), lxdSync(map[string]string{"target": "fp1"}))
+	f.handle("GET /1.0/images/fp1", lxdSync(map[string]interface{}{
+		"fingerprint": "fp1", "properties": map[string]string{runProperty: runID},
+	}))
+	f.handle("GET /1.0/images/fp1/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tarball"))
+	})
+	f.handle("DELETE /1.0/images/fp1", lxdSync(nil))
+
+	var (
+		mu     sync.Mutex
+		copies int
+	)
+	useRunner(t, runnerFunc(func(ctx context.Context, cmd Command) ([]byte, error) {
+		if cmd.Name == "zstd" {
+			_, err := io.Copy(cmd.Stdout, cmd.Stdin)
+			return nil, err
+		}
+		if cmd.Stdin != nil {
+			io.Copy(ioutil.Discard, cmd.Stdin)
+		}
+		if cmd.Args[0] != "copy" {
+			return []byte(`{"message_type":"summary","snapshot_id":"0123456789abcdef"}`), nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		copies++
+		if copies == 1 {
+			return nil, &CommandError{Command: cmd.String(), ExitCode: 1, Stderr: "Fatal: wrong password or no key found"}
+		}
+		return []byte("snapshot 89ef4567 saved\n"), nil
+	}))
+
+	config := &Config{
+		BackupResticRepos: []ResticRepo{{Path: "one"}, {Path: "two"}},
+		Replicate:         true,
+		Quorum:            Quorum{Retries: 1},
+		LocalWorkers:      1,
+	}
+	config.Stream = true
+	p := backupPipeline(config, 1)
+	p.Report = &Report{}
+	p.Sequential(context.Background(), []Container{c})
+
+	res := p.Report.Results[0]
+	if !res.OK() || len(res.Uploads) != 2 {
+		t.Fatalf("result = %+v", res)
+	}
+	// The retry went straight to the copy
+	n := 0
+	for _, r := range f.requests {
+		if r == "POST /1.0/instances/c1/snapshots" {
+			n++
+		}
+	}
+	if n != 1 || copies != 2 {
+		t.Errorf("%d snapshots and %d copies, want 1 and 2", n, copies)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prune applies the retention policies to the archives of every repo and
+// removes the data no snapshot refers to anymore. With -dry-run it only
+// prints which snapshots would be forgotten.
+func Prune(ctx context.Context, config *Config) {
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tARCHIVE\tKEEP\tREMOVE\tREMOVED")
+	for _, r := range config.resticRepos() {
+		log := log.WithField("repo", r.Path)
+		if !forgetArchives(ctx, config, r, w) {
+			failed = true
+			continue
+		}
+		if config.DryRun {
+			continue
+		}
+
+		t := time.Now()
+		err := r.Prune(ctx)
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintf(w, "%s\t-\t-\t-\tprune FAILED: %v\n", r.Path, err)
+			failed = true
+			continue
+		}
+		log.WithField("spent", time.Since(t)).Info("Prune restic repository")
+	}
+	w.Flush()
+	if config.DryRun {
+		fmt.Println("\nDry run, nothing was removed")
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// forgetArchives runs restic forget for every archive of the repo that has
+// a retention policy and tells whether all of them went fine.
+func forgetArchives(ctx context.Context, config *Config, r ResticRepo, w *tabwriter.Writer) bool {
+	rlog := log.WithField("repo", r.Path)
+	aa, err := r.archives(ctx)
+	if err != nil {
+		rlog.Error(err)
+		fmt.Fprintf(w, "%s\t-\t-\t-\tFAILED: %v\n", r.Path, err)
+		return false
+	}
+	ok := true
+	for _, a := range aa {
+		p := config.retention(r, a)
+		if p.empty() {
+			continue
+		}
+		t := time.Now()
+		g, err := r.Forget(ctx, a, p, config.DryRun)
+		if err != nil {
+			rlog.WithField("archive", a.String()).Error(err)
+			fmt.Fprintf(w, "%s\t%s\t-\t-\tFAILED: %v\n", r.Path, a, err)
+			ok = false
+			continue
+		}
+		var ids []string
+		for _, s := range g.Remove {
+			ids = append(ids, s.ShortID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", r.Path, a, len(g.Keep), len(g.Remove), strings.Join(ids, ","))
+		rlog.WithFields(log.Fields{
+			"archive": a.String(),
+			"spent":   time.Since(t),
+		}).Info("Forget restic snapshots")
+	}
+	return ok
+}
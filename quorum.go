@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Quorum is the number of repos a container must reach for its backup to
+// count. Without Min and Required every backup repo is needed. Required
+// repos are given by name or path. A container that misses the quorum is
+// backed up again from scratch up to Retries times.
+type Quorum struct {
+	Min      int      `yaml:"min"`
+	Required []string `yaml:"required"`
+	Retries  int      `yaml:"retries"`
+}
+
+func (q Quorum) String() string {
+	var rules []string
+	if q.Min > 0 {
+		rules = append(rules, fmt.Sprintf("at least %d repos", q.Min))
+	}
+	if len(q.Required) > 0 {
+		rules = append(rules, strings.Join(q.Required, ", "))
+	}
+	if len(rules) == 0 {
+		return "all repos"
+	}
+	return strings.Join(rules, " and ")
+}
+
+// validate makes sure the quorum can be reached at all.
+func (q Quorum) validate(repos []ResticRepo) error {
+	if q.Min > len(repos) {
+		return fmt.Errorf("The quorum asks for %d repos, but only %d are configured", q.Min, len(repos))
+	}
+	for _, name := range q.Required {
+		found := false
+		for _, r := range repos {
+			if r.Name == name || r.Path == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Required repo %s is not among backup_restic_repos", name)
+		}
+	}
+	return nil
+}
+
+// check tells whether the uploads fulfil the quorum over repos.
+func (q Quorum) check(repos []ResticRepo, uploads []backupSummary) error {
+	var reached []string
+	for _, u := range uploads {
+		if !contains(reached, u.Repo) {
+			reached = append(reached, u.Repo)
+		}
+	}
+
+	min := q.Min
+	if min == 0 && len(q.Required) == 0 {
+		min = len(repos)
+	}
+	if len(reached) < min {
+		return fmt.Errorf("Reached %d of %d repos, the quorum is %s", len(reached), len(repos), q)
+	}
+	for _, name := range q.Required {
+		found := false
+		for _, r := range repos {
+			if (r.Name == name || r.Path == name) && contains(reached, r.Path) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Required repo %s was not reached", name)
+		}
+	}
+	return nil
+}
+
+// quorumStage fails containers that did not reach enough repos, so that
+// they are retried. The failed repos themselves are reported as warnings.
+func quorumStage(q Quorum, repos []ResticRepo) Stage {
+	return Stage{
+		Name:    "Check repo quorum",
+		Workers: 1,
+		Retry:   true,
+		Do: func(_ context.Context, c *Container) error {
+			return q.check(repos, c.Uploads)
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadRepos are the repos archives are uploaded to. With replication
+// only the first backup repo gets them, the others are filled by restic
+// copy.
+func (c *Config) uploadRepos() []ResticRepo {
+	if c.Replicate && len(c.BackupResticRepos) > 0 {
+		return c.BackupResticRepos[:1]
+	}
+	return c.BackupResticRepos
+}
+
+// replicaRepos are the repos snapshots are copied to from the primary.
+func (c *Config) replicaRepos() []ResticRepo {
+	if !c.Replicate || len(c.BackupResticRepos) < 2 {
+		return nil
+	}
+	return c.BackupResticRepos[1:]
+}
+
+// copiedSnapshot matches the line restic copy prints for every snapshot it
+// saved in the destination repo.
+var copiedSnapshot = regexp.MustCompile(`snapshot ([0-9a-f]+) saved`)
+
+// Copy copies snapshot id from repo from, only the blobs missing in r are
+// transferred. It returns the ID of the copy.
+func (r *ResticRepo) Copy(ctx context.Context, from ResticRepo, id string) (string, error) {
+	cmd := r.command("copy", id)
+	cmd.Env = append(cmd.Env, from.fromEnv()...)
+	out, err := runner.Run(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	m := copiedSnapshot.FindSubmatch(out)
+	if m == nil {
+		// restic prints nothing when the snapshot is there already
+		return "", nil
+	}
+	return string(m[1]), nil
+}
+
+// fromEnv is the environment that makes the repo the source of restic copy
+// and restic init. Only the location and the password carry over, Env and
+// Options of the repo are not passed along as they would apply to the
+// destination as well.
+func (r *ResticRepo) fromEnv() []string {
+	var envs []string
+	for _, e := range r.env() {
+		for _, v := range []string{"RESTIC_REPOSITORY=", "RESTIC_PASSWORD=", "RESTIC_PASSWORD_FILE=", "RESTIC_PASSWORD_COMMAND="} {
+			if strings.HasPrefix(e, v) {
+				envs = append(envs, "RESTIC_FROM_"+strings.TrimPrefix(e, "RESTIC_"))
+			}
+		}
+	}
+	return envs
+}
+
+// chunkerPolynomial is the chunker parameter of the repo. Only repos that
+// share it deduplicate the data of each other.
+func (r *ResticRepo) chunkerPolynomial(ctx context.Context) (string, error) {
+	out, err := r.run(ctx, "cat", "config")
+	if err != nil {
+		return "", err
+	}
+	var c struct {
+		ChunkerPolynomial string `json:"chunker_polynomial"`
+	}
+	err = json.Unmarshal(out, &c)
+	return c.ChunkerPolynomial, err
+}
+
+// checkChunkerParams warns about replicas whose chunker parameters differ
+// from the primary. Copying to them still works, but every copy stores
+// its data anew instead of reusing what is already there.
+func checkChunkerParams(ctx context.Context, primary ResticRepo, replicas []ResticRepo) {
+	want, err := primary.chunkerPolynomial(ctx)
+	if err != nil {
+		log.WithField("repo", primary.Path).Warnf("Cannot read chunker parameters: %v", err)
+		return
+	}
+	for _, r := range replicas {
+		got, err := r.chunkerPolynomial(ctx)
+		if err != nil {
+			log.WithField("repo", r.Path).Warnf("Cannot read chunker parameters: %v", err)
+			continue
+		}
+		if got != want {
+			log.WithField("repo", r.Path).Warnf("Chunker parameters differ from %s, restic copy will not deduplicate. Initialize the repo with restic init --copy-chunker-params --from-repo %s", primary.Path, primary.Path)
+		}
+	}
+}
+
+// replicateStage copies the snapshot the container got in the primary
+// repo to every replica at once.
+func replicateStage(primary ResticRepo, replicas []ResticRepo, bw *bandwidth, policy RetryPolicy, timeout time.Duration) Stage {
+	f := newRepoFanOut(replicas, bw, policy, timeout)
+	return Stage{
+		Name:            "Copy snapshot to replica repos",
+		Workers:         f.workers(),
+		ContinueOnError: true,
+		Do: func(ctx context.Context, c *Container) error {
+			id := ""
+			for _, u := range c.Uploads {
+				if u.Repo == primary.Path {
+					id = u.SnapshotID
+				}
+			}
+			if id == "" {
+				// The primary upload failed, which the quorum reports
+				return nil
+			}
+
+			f.run(ctx, c, "Copy snapshot to", func(ctx context.Context, r ResticRepo) (backupSummary, error) {
+				copied, err := r.Copy(ctx, primary, id)
+				return backupSummary{Repo: r.Path, SnapshotID: copied}, err
+			})
+			return nil
+		},
+	}
+}
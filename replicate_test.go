@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		id   string
+	}{
+		{
+			name: "copied",
+			out: `repository 1234 opened (version 2)
+[0:01] 100.00%  1 / 1 snapshots
+
+snapshot 0123abcd of [/host-01/c1.tar.zst] at 2024-01-01 02:00:00 +0000 UTC)
+  copy started, this may take a while...
+snapshot 89ef4567 saved
+`,
+			id: "89ef4567",
+		},
+		{
+			name: "already there",
+			out:  "repository 1234 opened (version 2)\n",
+			id:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+				return []byte(tt.out), nil
+			}}
+			useRunner(t, f)
+
+			from := ResticRepo{Path: "primary", PasswordFile: "/etc/lxcer/primary", Env: map[string]string{"AWS_ACCESS_KEY_ID": "x"}}
+			r := ResticRepo{Path: "replica", Password: "two"}
+			id, err := r.Copy(context.Background(), from, "0123abcd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id {
+				t.Errorf("id = %q, want %q", id, tt.id)
+			}
+
+			c := f.commands[0]
+			if !reflect.DeepEqual(c.Args, []string{"copy", "0123abcd"}) {
+				t.Errorf("Args = %q", c.Args)
+			}
+			// The source only carries over location and password
+			wantEnv := []string{
+				"RESTIC_REPOSITORY=replica",
+				"RESTIC_PASSWORD=two",
+				"RESTIC_FROM_REPOSITORY=primary",
+				"RESTIC_FROM_PASSWORD_FILE=/etc/lxcer/primary",
+			}
+			if !reflect.DeepEqual(c.Env, wantEnv) {
+				t.Errorf("Env = %q, want %q", c.Env, wantEnv)
+			}
+		})
+	}
+}
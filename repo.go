@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RepoInit creates every configured repo that does not exist yet. With
+// replication the replicas take over the chunker parameters of the
+// primary.
+func RepoInit(ctx context.Context, config *Config) {
+	var primary *ResticRepo
+	if config.Replicate && len(config.BackupResticRepos) > 0 {
+		primary = &config.BackupResticRepos[0]
+	}
+
+	failed := false
+	for _, r := range config.resticRepos() {
+		log := log.WithField("repo", r.Path)
+		if r.initialized(ctx) {
+			fmt.Printf("%s: already initialized\n", r.Path)
+			continue
+		}
+		var from *ResticRepo
+		if primary != nil && contains(repoPaths(config.replicaRepos()), r.Path) {
+			from = primary
+		}
+		t := time.Now()
+		err := r.Init(ctx, from)
+		if err != nil {
+			log.Error(err)
+			fmt.Printf("%s: FAILED\n", r.Path)
+			failed = true
+			continue
+		}
+		log.WithField("spent", time.Since(t)).Info("Initialize restic repository")
+		if from != nil {
+			fmt.Printf("%s: initialized with the chunker parameters of %s\n", r.Path, from.Path)
+		} else {
+			fmt.Printf("%s: initialized\n", r.Path)
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// RepoCheck runs restic check against every repo, reading -read-data-subset
+// of the data if set.
+func RepoCheck(ctx context.Context, config *Config) {
+	failed := false
+	for _, r := range config.resticRepos() {
+		log := log.WithField("repo", r.Path)
+		t := time.Now()
+		err := r.Check(ctx, config.ReadDataSubset)
+		if err != nil {
+			log.Error(err)
+			fmt.Printf("%s: FAILED\n", r.Path)
+			failed = true
+			continue
+		}
+		log.WithField("spent", time.Since(t)).Info("restic repository is OK")
+		fmt.Printf("%s: OK\n", r.Path)
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// RepoUnlock removes stale locks from every repo.
+func RepoUnlock(ctx context.Context, config *Config) {
+	failed := false
+	for _, r := range config.resticRepos() {
+		err := r.Unlock(ctx, config.RemoveAll)
+		if err != nil {
+			log.WithField("repo", r.Path).Error(err)
+			fmt.Printf("%s: FAILED\n", r.Path)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: unlocked\n", r.Path)
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// RepoStats prints how much deduplicated data every container takes up in
+// every repo, and the size of each repo as a whole.
+func RepoStats(ctx context.Context, config *Config) {
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tARCHIVE\tSNAPSHOTS\tSIZE\tERROR")
+	for _, r := range config.resticRepos() {
+		log := log.WithField("repo", r.Path)
+		aa, err := r.archives(ctx)
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%v\n", r.Path, err)
+			failed = true
+			continue
+		}
+		for i := range aa {
+			st, err := r.Stats(ctx, &aa[i])
+			if err != nil {
+				log.WithField("archive", aa[i].String()).Error(err)
+				fmt.Fprintf(w, "%s\t%s\t-\t-\t%v\n", r.Path, aa[i], err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t\n", r.Path, aa[i], st.SnapshotsCount, formatBytes(st.TotalSize))
+		}
+		st, err := r.Stats(ctx, nil)
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintf(w, "%s\t(total)\t-\t-\t%v\n", r.Path, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(w, "%s\t(total)\t%d\t%s\t\n", r.Path, st.SnapshotsCount, formatBytes(st.TotalSize))
+	}
+	w.Flush()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+func repoPaths(rr []ResticRepo) []string {
+	var pp []string
+	for _, r := range rr {
+		pp = append(pp, r.Path)
+	}
+	return pp
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of runs that work on several containers, so that cron and
+// systemd can tell a partial failure from a total one.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitPartial = 2
+)
+
+// Result is the outcome of a single container in a run. Container is empty
+// when the host itself failed, e.g. its containers could not be listed.
+type Result struct {
+	Host      string
+	Container string
+	Errors    []string
+	// Warnings are failures that did not fail the container, e.g. a
+	// repo that was not reached while the quorum was
+	Warnings []string
+	// Uploads are the restic snapshots saved for the container
+	Uploads []backupSummary
+	// Retries are the errors the container was retried after
+	Retries []string
+	Spent   time.Duration
+}
+
+func (r Result) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// Report collects results from every worker of a run.
+type Report struct {
+	mu      sync.Mutex
+	Results []Result
+}
+
+func (r *Report) Add(res Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Results = append(r.Results, res)
+}
+
+func (r *Report) failed() int {
+	n := 0
+	for _, res := range r.Results {
+		if !res.OK() {
+			n++
+		}
+	}
+	return n
+}
+
+// ExitCode is exitOK when everything went fine, exitFailure when nothing
+// did and exitPartial otherwise.
+func (r *Report) ExitCode() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := r.failed()
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed == len(r.Results):
+		return exitFailure
+	default:
+		return exitPartial
+	}
+}
+
+// Print writes the summary table of the run.
+func (r *Report) Print(out io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.SliceStable(r.Results, func(i, j int) bool {
+		if r.Results[i].Host != r.Results[j].Host {
+			return r.Results[i].Host < r.Results[j].Host
+		}
+		return r.Results[i].Container < r.Results[j].Container
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCONTAINER\tSTATUS\tSPENT\tRETRIES\tSNAPSHOTS\tADDED\tERROR")
+	for _, res := range r.Results {
+		status := "ok"
+		if !res.OK() {
+			status = "FAILED"
+		}
+		container := res.Container
+		if container == "" {
+			container = "-"
+		}
+		snapshots, added := "-", "-"
+		if len(res.Uploads) > 0 {
+			var (
+				ids []string
+				n   uint64
+			)
+			for _, u := range res.Uploads {
+				ids = append(ids, u.ShortID())
+				n += u.DataAdded
+			}
+			snapshots, added = strings.Join(ids, ","), formatBytes(n)
+		}
+		problems := res.Errors
+		for _, warn := range res.Warnings {
+			problems = append(problems, "warning: "+warn)
+		}
+		for _, retry := range res.Retries {
+			problems = append(problems, "retried: "+retry)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", res.Host, container, status, res.Spent.Round(time.Second), len(res.Retries), snapshots, added, strings.Join(problems, "; "))
+	}
+	w.Flush()
+
+	failed := r.failed()
+	fmt.Fprintf(out, "\n%d ok, %d failed\n", len(r.Results)-failed, failed)
+}
@@ -2,76 +2,407 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type ResticRepo struct {
+	// Name refers to the repo in the quorum, it defaults to Path
+	Name     string `yaml:"name"`
 	Path     string `yaml:"path"`
 	Password string `yaml:"password"`
+	// PasswordFile and PasswordCommand keep the password out of the config
+	PasswordFile    string `yaml:"password_file"`
+	PasswordCommand string `yaml:"password_command"`
+	// Env is added to the environment of restic, e.g. backend credentials,
+	// RESTIC_CACHE_DIR or RESTIC_PACK_SIZE
+	Env map[string]string `yaml:"env"`
+	// Options are extra restic flags put in front of every command, e.g.
+	// ["--pack-size", "64", "-o", "s3.connections=10"]
+	Options []string `yaml:"options"`
+	// LimitUpload and LimitDownload cap the bandwidth of restic in KiB/s
+	LimitUpload   int        `yaml:"limit_upload"`
+	LimitDownload int        `yaml:"limit_download"`
+	Retention     *Retention `yaml:"retention"`
+	// Workers is the number of archives uploaded to the repo at once
+	Workers int `yaml:"workers"`
 }
 
-func (r *ResticRepo) Check() {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
-	cmd := exec.Command("restic", "check")
-	cmd.Env = r.setEnv()
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+func (r *ResticRepo) workers() int {
+	if r.Workers < 1 {
+		return 1
+	}
+	return r.Workers
+}
+
+// Check verifies the structure of the repo and, with subset (e.g. "10%"
+// or "1/5"), reads and verifies that part of the data too.
+func (r *ResticRepo) Check(ctx context.Context, subset string) error {
+	args := []string{"check"}
+	if subset != "" {
+		args = append(args, "--read-data-subset", subset)
+	}
+	_, err := r.run(ctx, args...)
+	return err
+}
+
+// Init creates the repo. When from is given, the new repo takes over its
+// chunker parameters so that restic copy between them deduplicates.
+func (r *ResticRepo) Init(ctx context.Context, from *ResticRepo) error {
+	if from == nil {
+		_, err := r.run(ctx, "init")
+		return err
+	}
+	cmd := r.command("init", "--copy-chunker-params")
+	cmd.Env = append(cmd.Env, from.fromEnv()...)
+	_, err := runner.Run(ctx, cmd)
+	return err
+}
+
+// initialized tells whether the repo exists and can be opened.
+func (r *ResticRepo) initialized(ctx context.Context) bool {
+	_, err := r.run(ctx, "cat", "config")
+	return err == nil
+}
+
+// Unlock removes stale locks, with removeAll every lock.
+func (r *ResticRepo) Unlock(ctx context.Context, removeAll bool) error {
+	args := []string{"unlock"}
+	if removeAll {
+		args = append(args, "--remove-all")
+	}
+	_, err := r.run(ctx, args...)
+	return err
+}
+
+type resticStats struct {
+	TotalSize      uint64 `json:"total_size"`
+	SnapshotsCount int    `json:"snapshots_count"`
+}
+
+// Stats returns the size of the deduplicated data the snapshots of archive
+// a refer to, or of the whole repo if a is nil.
+func (r *ResticRepo) Stats(ctx context.Context, a *Archive) (resticStats, error) {
+	var st resticStats
+	args := []string{"stats", "--json", "--mode", "raw-data"}
+	if a != nil {
+		args = append(args, "--host", a.Host, "--tag", archiveTag+","+tag(tagContainer, a.Container))
+	}
+	out, err := r.run(ctx, args...)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(out, &st)
+	return st, err
+}
+
+// RestoreSize returns the size of the files in snapshot id, for snapshots
+// that restic before 0.17 saved without a summary.
+func (r *ResticRepo) RestoreSize(ctx context.Context, id string) (uint64, error) {
+	var st resticStats
+	out, err := r.run(ctx, "stats", "--json", "--mode", "restore-size", id)
+	if err != nil {
+		return 0, err
+	}
+	err = json.Unmarshal(out, &st)
+	return st.TotalSize, err
+}
+
+func (r *ResticRepo) Prune(ctx context.Context) error {
+	_, err := r.run(ctx, "prune")
+	return err
+}
+
+// backupSummary is the summary restic backup --json prints once it saved
+// a snapshot.
+type backupSummary struct {
+	Repo                string  `json:"-"`
+	MessageType         string  `json:"message_type"`
+	SnapshotID          string  `json:"snapshot_id"`
+	FilesNew            int     `json:"files_new"`
+	FilesChanged        int     `json:"files_changed"`
+	FilesUnmodified     int     `json:"files_unmodified"`
+	TotalFilesProcessed int     `json:"total_files_processed"`
+	TotalBytesProcessed uint64  `json:"total_bytes_processed"`
+	DataAdded           uint64  `json:"data_added"`
+	TotalDuration       float64 `json:"total_duration"`
+}
+
+// ShortID is the snapshot ID the way restic snapshots prints it.
+func (s backupSummary) ShortID() string {
+	if len(s.SnapshotID) > 8 {
+		return s.SnapshotID[:8]
+	}
+	return s.SnapshotID
+}
+
+// Backup stores the staged archive under the host it was taken from.
+func (r *ResticRepo) Backup(ctx context.Context, a Archive) (backupSummary, error) {
+	args := append([]string{"backup", "--json"}, a.resticArgs()...)
+	out, err := r.run(ctx, append(args, a.File())...)
+	if err != nil {
+		return backupSummary{}, err
+	}
+	return r.backupSummary(a, out)
+}
+
+// BackupStdin stores everything read from stdin as archive a.
+func (r *ResticRepo) BackupStdin(ctx context.Context, a Archive, stdin io.Reader) (backupSummary, error) {
+	args := append([]string{"backup", "--json"}, a.resticArgs()...)
+	cmd := r.command(append(args, "--stdin", "--stdin-filename", a.File())...)
+	cmd.Stdin = stdin
+	out, err := runner.Run(ctx, cmd)
+	if err != nil {
+		return backupSummary{}, err
+	}
+	return r.backupSummary(a, out)
+}
+
+// backupSummary picks the summary out of the status lines of restic backup
+// --json and logs it.
+func (r *ResticRepo) backupSummary(a Archive, out []byte) (backupSummary, error) {
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		var s backupSummary
+		if json.Unmarshal(line, &s) != nil || s.MessageType != "summary" {
+			continue
+		}
+		s.Repo = r.Path
+		log.WithFields(log.Fields{
+			"repo":      r.Path,
+			"archive":   a.String(),
+			"snapshot":  s.ShortID(),
+			"files":     s.TotalFilesProcessed,
+			"processed": formatBytes(s.TotalBytesProcessed),
+			"added":     formatBytes(s.DataAdded),
+			"duration":  time.Duration(s.TotalDuration * float64(time.Second)),
+		}).Info("restic snapshot saved")
+		return s, nil
+	}
+	return backupSummary{}, fmt.Errorf("restic backup to %s printed no summary", r.Path)
+}
+
+type resticSnapshot struct {
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+	// Summary is only there with restic 0.17 and later
+	Summary *struct {
+		TotalBytesProcessed uint64 `json:"total_bytes_processed"`
+	} `json:"summary"`
+}
+
+func (r *ResticRepo) Snapshots(ctx context.Context) ([]resticSnapshot, error) {
+	out, err := r.run(ctx, "snapshots", "--json")
+	if err != nil {
+		return nil, err
+	}
+	var ss []resticSnapshot
+	err = json.Unmarshal(out, &ss)
 	if err != nil {
-		log.Fatalln(Stderr.String())
+		return nil, err
 	}
-	log.Infof("restic repository %s is OK", r.Path)
+	return ss, nil
 }
 
-func (r *ResticRepo) Backup(path string) error {
+// findSnapshot finds the newest snapshot holding archive a, no matter
+// whether it was uploaded from a file or streamed, and returns its ID and
+// the path the archive was backed up from. Without a host a must be unique
+// across hosts, a snapshot prefix must be unique among the snapshots of a.
+func (r *ResticRepo) findSnapshot(ctx context.Context, a Archive) (string, string, error) {
+	ss, err := r.Snapshots(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
 	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
+		latest *resticSnapshot
+		file   string
+		hosts  []string
+		ids    []string
 	)
-	cmd := exec.Command("restic", "backup", path)
-	cmd.Env = r.setEnv()
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
+	for i, s := range ss {
+		for _, p := range s.Paths {
+			b, ok := snapshotArchive(s, p)
+			if !ok || !a.Matches(b) {
+				continue
+			}
+			if a.Snapshot != "" && !strings.HasPrefix(s.ID, a.Snapshot) {
+				continue
+			}
+			if !a.At.IsZero() && s.Time.After(a.At) {
+				continue
+			}
+			if !contains(hosts, b.Host) {
+				hosts = append(hosts, b.Host)
+			}
+			if !contains(ids, s.ID) {
+				ids = append(ids, s.ID)
+			}
+			if latest == nil || s.Time.After(latest.Time) {
+				latest = &ss[i]
+				file = p
+			}
+		}
+	}
+	if latest == nil {
+		switch {
+		case a.Snapshot != "":
+			return "", "", fmt.Errorf("Snapshot %s of %s not found in restic repository %s", a.Snapshot, a, r.Path)
+		case !a.At.IsZero():
+			return "", "", fmt.Errorf("No snapshot of %s at or before %s in restic repository %s", a, a.At.Format(time.RFC3339), r.Path)
+		}
+		return "", "", fmt.Errorf("No snapshot of %s in restic repository %s", a, r.Path)
+	}
+	if len(hosts) > 1 {
+		return "", "", fmt.Errorf("%s is backed up from several hosts (%s), restore host/%s instead", a, strings.Join(hosts, ", "), a.Container)
+	}
+	if a.Snapshot != "" && len(ids) > 1 {
+		return "", "", fmt.Errorf("Snapshot %s of %s is ambiguous in restic repository %s, it matches %s", a.Snapshot, a, r.Path, strings.Join(ids, ", "))
+	}
+	return latest.ID, file, nil
+}
+
+// Restore writes archive a to its staging path.
+func (r *ResticRepo) Restore(ctx context.Context, a Archive) error {
+	err := a.mkdir()
 	if err != nil {
 		return err
 	}
+	created.add(fileArtifact(a.File()))
+	f, err := os.Create(a.File())
+	if err != nil {
+		return err
+	}
+	err = r.Dump(ctx, a, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeFile(a.File())
+		return err
+	}
 	return nil
 }
 
-// restic restore latest --path cachet-mz.tar.zst --target .
-func (r *ResticRepo) Restore(cname string) error {
-	var (
-		Stdout bytes.Buffer
-		Stderr bytes.Buffer
-	)
+// Dump writes archive a to w.
+// restic dump <id> /host-01/cachet-mz.tar.zst
+func (r *ResticRepo) Dump(ctx context.Context, a Archive, w io.Writer) error {
+	id, file, err := r.findSnapshot(ctx, a)
+	if err != nil {
+		return err
+	}
+	file, err = r.treePath(ctx, id, file)
+	if err != nil {
+		return err
+	}
+	cmd := r.command("dump", id, file)
+	cmd.Stdout = w
+	_, err = runner.Run(ctx, cmd)
+	return err
+}
 
-	zst := fmt.Sprintf("%s.tar.zst", cname)
+// treePath is where file is stored inside snapshot id. Streamed archives
+// are stored under the path they were backed up as. Files are backed up
+// relative to the working directory: restic records the absolute path,
+// but stores the file relative to the root of the snapshot.
+func (r *ResticRepo) treePath(ctx context.Context, id, file string) (string, error) {
+	out, err := r.run(ctx, "ls", "--json", id)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		var n struct {
+			Type string `json:"type"`
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(line, &n) != nil || n.Type != "file" {
+			continue
+		}
+		if strings.HasSuffix(file, n.Path) && len(n.Path) > len(found) {
+			found = n.Path
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("%s not found in snapshot %s of restic repository %s", file, id, r.Path)
+	}
+	return found, nil
+}
 
-	cmd := exec.Command("restic", "restore", "latest", "--path", zst, "--target", ".")
+// run invokes restic against the repository.
+func (r *ResticRepo) run(ctx context.Context, args ...string) ([]byte, error) {
+	return runner.Run(ctx, r.command(args...))
+}
 
-	cmd.Env = r.setEnv()
-	cmd.Stdout = &Stdout
-	cmd.Stderr = &Stderr
-	err := cmd.Run()
-	if err != nil {
-		return err
+// command is the restic invocation of args against the repository.
+func (r *ResticRepo) command(args ...string) Command {
+	flags := append([]string{}, r.Options...)
+	if r.LimitUpload > 0 {
+		flags = append(flags, "--limit-upload", strconv.Itoa(r.LimitUpload))
+	}
+	if r.LimitDownload > 0 {
+		flags = append(flags, "--limit-download", strconv.Itoa(r.LimitDownload))
+	}
+	return Command{
+		Name: "restic",
+		Args: append(flags, args...),
+		Env:  r.env(),
+	}
+}
+
+// validate makes sure the repo sets one way of passing the password at
+// most, restic refuses the password file and command together and would
+// silently prefer either over the password.
+func (r *ResticRepo) validate() error {
+	var set []string
+	for _, p := range []struct {
+		key   string
+		value string
+	}{
+		{"password", r.Password},
+		{"password_file", r.PasswordFile},
+		{"password_command", r.PasswordCommand},
+	} {
+		if p.value != "" {
+			set = append(set, p.key)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("Restic repo %s sets %s, please set only one of them", r.Path, strings.Join(set, " and "))
 	}
 	return nil
 }
 
-func (r *ResticRepo) setEnv() []string {
-	var envs []string
-	envs = append(envs, os.Environ()...)
-	// envs = append(envs, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
-	envs = append(envs, fmt.Sprintf("RESTIC_REPOSITORY=%s", r.Path))
-	envs = append(envs, fmt.Sprintf("RESTIC_PASSWORD=%s", r.Password))
+func (r *ResticRepo) env() []string {
+	envs := []string{fmt.Sprintf("RESTIC_REPOSITORY=%s", r.Path)}
+	if r.Password != "" {
+		envs = append(envs, fmt.Sprintf("RESTIC_PASSWORD=%s", r.Password))
+	}
+	if r.PasswordFile != "" {
+		envs = append(envs, fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", r.PasswordFile))
+	}
+	if r.PasswordCommand != "" {
+		envs = append(envs, fmt.Sprintf("RESTIC_PASSWORD_COMMAND=%s", r.PasswordCommand))
+	}
+	keys := make([]string, 0, len(r.Env))
+	for k := range r.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		envs = append(envs, fmt.Sprintf("%s=%s", k, r.Env[k]))
+	}
 	return envs
 }
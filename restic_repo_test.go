@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResticRepoCommand(t *testing.T) {
+	r := ResticRepo{
+		Path:          "s3:bucket/lxcer",
+		PasswordFile:  "/etc/lxcer/pass",
+		Env:           map[string]string{"B": "2", "A": "1"},
+		Options:       []string{"-o", "s3.connections=10"},
+		LimitUpload:   100,
+		LimitDownload: 200,
+	}
+	c := r.command("snapshots", "--json")
+
+	if c.Name != "restic" {
+		t.Errorf("Name = %q, want restic", c.Name)
+	}
+	wantArgs := []string{"-o", "s3.connections=10", "--limit-upload", "100", "--limit-download", "200", "snapshots", "--json"}
+	if !reflect.DeepEqual(c.Args, wantArgs) {
+		t.Errorf("Args = %q, want %q", c.Args, wantArgs)
+	}
+	wantEnv := []string{
+		"RESTIC_REPOSITORY=s3:bucket/lxcer",
+		"RESTIC_PASSWORD_FILE=/etc/lxcer/pass",
+		"A=1",
+		"B=2",
+	}
+	if !reflect.DeepEqual(c.Env, wantEnv) {
+		t.Errorf("Env = %q, want %q", c.Env, wantEnv)
+	}
+}
+
+func TestResticRepoValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		repo ResticRepo
+		err  string
+	}{
+		{name: "password", repo: ResticRepo{Path: "one", Password: "pw"}},
+		{name: "file", repo: ResticRepo{Path: "one", PasswordFile: "/etc/lxcer/pass"}},
+		{name: "command", repo: ResticRepo{Path: "one", PasswordCommand: "pass show restic"}},
+		{name: "none", repo: ResticRepo{Path: "one"}},
+		{name: "password and file", repo: ResticRepo{Path: "one", Password: "pw", PasswordFile: "/etc/lxcer/pass"}, err: "sets password and password_file"},
+		{name: "file and command", repo: ResticRepo{Path: "one", PasswordFile: "/etc/lxcer/pass", PasswordCommand: "pass show restic"}, err: "sets password_file and password_command"},
+		{name: "all", repo: ResticRepo{Path: "one", Password: "pw", PasswordFile: "/etc/lxcer/pass", PasswordCommand: "pass show restic"}, err: "sets password and password_file and password_command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.repo.validate()
+			if tt.err == "" && err != nil {
+				t.Errorf("err = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResticRepoCommandPlain(t *testing.T) {
+	r := ResticRepo{Path: "/srv/restic", Password: "pw"}
+	c := r.command("check")
+	if !reflect.DeepEqual(c.Args, []string{"check"}) {
+		t.Errorf("Args = %q, want [check]", c.Args)
+	}
+	if !reflect.DeepEqual(c.Env, []string{"RESTIC_REPOSITORY=/srv/restic", "RESTIC_PASSWORD=pw"}) {
+		t.Errorf("Env = %q", c.Env)
+	}
+}
+
+func TestBackupSummary(t *testing.T) {
+	f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+		return []byte(`{"message_type":"status","percent_done":0.5}
+{"message_type":"summary","files_new":1,"total_files_processed":1,"total_bytes_processed":2048,"data_added":1024,"total_duration":1.5,"snapshot_id":"0123456789abcdef"}
+`), nil
+	}}
+	useRunner(t, f)
+
+	r := ResticRepo{Path: "one"}
+	a := Archive{Host: "host-01", Container: "c1", Tags: []string{archiveTag, "run=x"}}
+	s, err := r.Backup(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Repo != "one" || s.SnapshotID != "0123456789abcdef" || s.ShortID() != "01234567" {
+		t.Errorf("summary = %+v", s)
+	}
+	if s.DataAdded != 1024 || s.TotalBytesProcessed != 2048 || s.TotalFilesProcessed != 1 {
+		t.Errorf("summary = %+v", s)
+	}
+
+	want := "restic backup --json --host host-01 --tag lxcer --tag run=x host-01/c1.tar.zst"
+	if got := f.commands[0].String(); got != want {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+}
+
+func TestBackupSummaryMissing(t *testing.T) {
+	useRunner(t, &fakeRunner{respond: func(c Command) ([]byte, error) {
+		return []byte(`{"message_type":"status"}`), nil
+	}})
+	r := ResticRepo{Path: "one"}
+	_, err := r.Backup(context.Background(), Archive{Host: "h", Container: "c"})
+	if err == nil || !strings.Contains(err.Error(), "no summary") {
+		t.Errorf("err = %v, want no summary", err)
+	}
+}
+
+const snapshotsJSON = `[
+  {"id":"aaaa7777","time":"2023-12-31T02:00:00Z","hostname":"host-01","paths":["/host-01/c1.tar.zst"],"tags":["lxcer","host=host-01","container=c1","run=r0"]},
+  {"id":"aaaa1111","time":"2024-01-01T02:00:00Z","hostname":"host-01","paths":["/host-01/c1.tar.zst"],"tags":["lxcer","host=host-01","container=c1","run=r1"]},
+  {"id":"bbbb2222","time":"2024-01-02T02:00:00Z","hostname":"host-01","paths":["/host-01/c1.tar.zst"],"tags":["lxcer","host=host-01","container=c1","run=r2"]},
+  {"id":"cccc3333","time":"2024-01-03T02:00:00Z","hostname":"backup","paths":["/host-02/c1.tar.zst"],"tags":["lxcer","host=host-02","container=c1","run=r3"]},
+  {"id":"dddd4444","time":"2024-01-03T02:00:00Z","hostname":"host-01","paths":["/host-01/c2.tar.zst"],"tags":["lxcer","host=host-01","container=c2","run=r3"]},
+  {"id":"eeee5555","time":"2024-01-03T02:00:00Z","hostname":"host-01","paths":["/var/lib/lxcer/host-01/c3.tar.zst"],"tags":["lxcer","host=host-01","container=c3","run=r3"]},
+  {"id":"ffff6666","time":"2023-01-01T02:00:00Z","hostname":"host-01","paths":["/var/lib/lxcer/c4.tar.zst"],"tags":null}
+]`
+
+func TestFindSnapshot(t *testing.T) {
+	useRunner(t, &fakeRunner{respond: func(c Command) ([]byte, error) {
+		return []byte(snapshotsJSON), nil
+	}})
+	r := ResticRepo{Path: "one"}
+	at := func(s string) time.Time {
+		tt, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tt
+	}
+
+	tests := []struct {
+		name    string
+		a       Archive
+		id      string
+		file    string
+		wantErr string
+	}{
+		{name: "latest", a: Archive{Host: "host-01", Container: "c1"}, id: "bbbb2222", file: "/host-01/c1.tar.zst"},
+		{name: "tag", a: Archive{Host: "host-01", Container: "c1", Tags: []string{"run=r1"}}, id: "aaaa1111"},
+		{name: "snapshot prefix", a: Archive{Host: "host-01", Container: "c1", Snapshot: "aaaa1"}, id: "aaaa1111"},
+		{name: "full snapshot ID", a: Archive{Host: "host-01", Container: "c1", Snapshot: "aaaa7777"}, id: "aaaa7777"},
+		{name: "at", a: Archive{Host: "host-01", Container: "c1", At: at("2024-01-01T12:00:00Z")}, id: "aaaa1111"},
+		{name: "tagged host wins", a: Archive{Host: "host-02", Container: "c1"}, id: "cccc3333", file: "/host-02/c1.tar.zst"},
+		{name: "unique without host", a: Archive{Container: "c2"}, id: "dddd4444"},
+		{name: "file", a: Archive{Host: "host-01", Container: "c3"}, id: "eeee5555", file: "/var/lib/lxcer/host-01/c3.tar.zst"},
+		{name: "untagged", a: Archive{Host: "host-01", Container: "c4"}, id: "ffff6666", file: "/var/lib/lxcer/c4.tar.zst"},
+		{name: "ambiguous host", a: Archive{Container: "c1"}, wantErr: "several hosts"},
+		{name: "ambiguous snapshot", a: Archive{Host: "host-01", Container: "c1", Snapshot: "aaaa"}, wantErr: "matches aaaa7777, aaaa1111"},
+		{name: "unknown snapshot", a: Archive{Host: "host-01", Container: "c1", Snapshot: "ffff"}, wantErr: "Snapshot ffff"},
+		{name: "too early", a: Archive{Host: "host-01", Container: "c1", At: at("2023-01-01T00:00:00Z")}, wantErr: "at or before"},
+		{name: "missing", a: Archive{Host: "host-01", Container: "c9"}, wantErr: "No snapshot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, file, err := r.findSnapshot(context.Background(), tt.a)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id {
+				t.Errorf("id = %s, want %s", id, tt.id)
+			}
+			if tt.file != "" && file != tt.file {
+				t.Errorf("file = %s, want %s", file, tt.file)
+			}
+		})
+	}
+}
+
+func TestRestoreSize(t *testing.T) {
+	f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+		return []byte(`{"total_size":4096,"total_file_count":1,"snapshots_count":1}`), nil
+	}}
+	useRunner(t, f)
+
+	r := ResticRepo{Path: "one"}
+	size, err := r.RestoreSize(context.Background(), "aaaa1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 {
+		t.Errorf("size = %d, want 4096", size)
+	}
+	want := []string{"stats", "--json", "--mode", "restore-size", "aaaa1111"}
+	if !reflect.DeepEqual(f.commands[0].Args, want) {
+		t.Errorf("Args = %q, want %q", f.commands[0].Args, want)
+	}
+}
+
+func TestDump(t *testing.T) {
+	// What restic ls --json shows for each snapshot: streamed archives
+	// keep their path, files backed up from the working directory are
+	// stored relative to the snapshot root, as were those of lxcer
+	// versions that did not namespace archives by host
+	trees := map[string]string{
+		"bbbb2222": "/host-01/c1.tar.zst",
+		"eeee5555": "/host-01/c3.tar.zst",
+		"ffff6666": "/c4.tar.zst",
+	}
+	f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+		switch c.Args[0] {
+		case "snapshots":
+			return []byte(snapshotsJSON), nil
+		case "ls":
+			dir := path.Dir(trees[c.Args[2]])
+			return []byte(`{"struct_type":"snapshot","id":"` + c.Args[2] + `"}
+{"name":"` + path.Base(dir) + `","type":"dir","path":"` + dir + `","struct_type":"node"}
+{"name":"` + path.Base(trees[c.Args[2]]) + `","type":"file","path":"` + trees[c.Args[2]] + `","struct_type":"node"}
+`), nil
+		}
+		return nil, nil
+	}}
+	useRunner(t, f)
+
+	r := ResticRepo{Path: "one"}
+	for _, container := range []string{"c1", "c3", "c4"} {
+		t.Run(container, func(t *testing.T) {
+			f.commands = nil
+			err := r.Dump(context.Background(), Archive{Host: "host-01", Container: container}, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dump := f.commands[len(f.commands)-1]
+			id := dump.Args[1]
+			if dump.Args[0] != "dump" || dump.Args[2] != trees[id] {
+				t.Errorf("command = %q, want restic dump %s %s", dump.String(), id, trees[id])
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func Restore(ctx context.Context, config *Config) {
+	if !config.Local && config.RemoteHost == "" {
+		log.Fatalln("Please set -remote-host or -local flag to restore")
+	}
+
+	if config.Snapshot != "" && config.RestoreList != "" {
+		log.Fatalln("-snapshot picks the snapshot of a single container, use -at with -restore-list")
+	}
+	if config.Snapshot != "" && !config.At.IsZero() {
+		log.Fatalln("Please set either -snapshot or -at")
+	}
+
+	if config.Cleanup {
+		cleanupLocal(ctx)
+	}
+
+	report := &Report{}
+
+	switch {
+	case config.Container != "" && config.RestoreAs != "":
+		j := newRestoreJob(config, config.Container, config.RestoreAs)
+		j.finish(report, j.run(ctx, config))
+	case config.RestoreList != "" && config.Concurrently:
+		restoreConcurrently(ctx, config, report)
+	case config.RestoreList != "":
+		for k, v := range config.ContList {
+			j := newRestoreJob(config, k, v)
+			if interrupted() {
+				j.skip(report)
+				continue
+			}
+			j.finish(report, j.run(ctx, config))
+		}
+	default:
+		log.Fatalln("Please set -container and -as or -restore-list flag to restore")
+	}
+
+	if interrupted() {
+		log.Warn("Restore was interrupted")
+	}
+	created.rollback()
+	report.Print(os.Stdout)
+	os.Exit(report.ExitCode())
+}
+
+// restoreHost returns the LXD remote containers are restored to.
+func restoreHost(config *Config) string {
+	if config.Local {
+		return localHost
+	}
+	return config.RemoteHost
+}
+
+// restoreJob is the restore of a single container. It keeps track of what
+// it created on the host so that a failed restore can be rolled back
+// without touching anything else.
+type restoreJob struct {
+	host      string
+	source    Archive
+	restoreAs string
+	alias     string
+	start     time.Time
+	log       *log.Entry
+	imported  bool
+	created   bool
+	// warnings are the repos that failed before one delivered
+	warnings []string
+	// startTimeout limits creating and starting the container
+	startTimeout time.Duration
+}
+
+// newRestoreJob restores source to the host of the config, picking the
+// snapshot by the -tag, -snapshot and -at options.
+func newRestoreJob(config *Config, source, restoreAs string) *restoreJob {
+	host := restoreHost(config)
+	a := parseArchive(source)
+	a.Tags = config.Tags
+	a.Snapshot = config.Snapshot
+	a.At = config.At.Time
+	return &restoreJob{
+		host:      host,
+		source:    a,
+		restoreAs: restoreAs,
+		alias:     runAlias(host, restoreAs),
+		start:     time.Now(),
+		log: log.WithFields(log.Fields{
+			"host":   host,
+			"source": source,
+		}),
+		startTimeout: config.stageTimeout("start"),
+	}
+}
+
+// run restores the container and starts it.
+func (j *restoreJob) run(ctx context.Context, config *Config) error {
+	err := j.fetch(ctx, config)
+	if err != nil {
+		return err
+	}
+	return j.launch(ctx)
+}
+
+// fetch brings the archive of the source from restic to the host as an
+// image of this run, either streamed or through files in the working
+// directory. The restore repos are tried in order until one of them
+// delivers.
+func (j *restoreJob) fetch(ctx context.Context, config *Config) error {
+	repos := config.restoreRepos()
+	if len(repos) == 0 {
+		return errors.New("No restic repos to restore from")
+	}
+
+	var failed []string
+	for i, r := range repos {
+		err := j.fetchFrom(ctx, config, r)
+		if err == nil {
+			j.warnings = failed
+			break
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", r.Path, err))
+		j.removeFiles()
+		// Another repo would not make LXD take the image
+		var lxdErr *LXDError
+		if errors.As(err, &lxdErr) || i == len(repos)-1 {
+			return errors.New(strings.Join(failed, "; "))
+		}
+		j.log.WithField("repo", r.Path).Warnf("Cannot restore from repo, trying the next one: %v", err)
+	}
+	if config.Stream {
+		return nil
+	}
+
+	t := time.Now()
+	err := withTimeout(ctx, config.stageTimeout("import"), func(ctx context.Context) error {
+		return ImportImage(ctx, j.host, j.source.Tar(), j.alias, j.restoreAs)
+	})
+	if err != nil {
+		return err
+	}
+	j.imported = true
+	j.log.WithField("spent", time.Since(t)).Info("Import LXD image from .tar")
+
+	t = time.Now()
+	err = DeleteImageTar(j.source)
+	if err != nil {
+		return err
+	}
+	j.log.WithField("spent", time.Since(t)).Info("Delete .tar")
+	return nil
+}
+
+// fetchFrom reads the archive from repo r. In stream mode it ends up as
+// the imported image, otherwise as a .tar in the working directory. The
+// dump, stream and all, is given the timeout of dump.
+func (j *restoreJob) fetchFrom(ctx context.Context, config *Config, r ResticRepo) error {
+	log := j.log.WithField("repo", r.Path)
+	dumpTimeout := config.stageTimeout("dump")
+	if config.Stream {
+		t := time.Now()
+		err := withTimeout(ctx, dumpTimeout, func(ctx context.Context) error {
+			return StreamRestore(ctx, r, j.host, j.source, j.restoreAs, j.alias)
+		})
+		if err != nil {
+			return err
+		}
+		j.imported = true
+		log.WithField("spent", time.Since(t)).Info("Stream restic dump through zstd into LXD image")
+		return nil
+	}
+
+	t := time.Now()
+	err := withTimeout(ctx, dumpTimeout, func(ctx context.Context) error {
+		return r.Restore(ctx, j.source)
+	})
+	if err != nil {
+		return err
+	}
+	log.WithField("spent", time.Since(t)).Info("Restore .tar.zst from restic")
+
+	t = time.Now()
+	err = withTimeout(ctx, config.stageTimeout("decompress"), func(ctx context.Context) error {
+		return DecompressWithZst(ctx, j.source)
+	})
+	if err != nil {
+		return err
+	}
+	log.WithField("spent", time.Since(t)).Info("Decompress .tar.zst to .tar")
+
+	t = time.Now()
+	err = DeleteImageTarZst(j.source)
+	if err != nil {
+		return err
+	}
+	log.WithField("spent", time.Since(t)).Info("Delete .tar.zst")
+	return nil
+}
+
+// launch starts the restored container from the imported image and
+// removes the image afterwards. A virtual machine is restored as one, LXD
+// tells by the image.
+func (j *restoreJob) launch(ctx context.Context) error {
+	l, err := lxdClient(j.host)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	err = withTimeout(ctx, j.startTimeout, func(ctx context.Context) error {
+		img, err := l.Image(ctx, j.alias)
+		if err != nil {
+			return err
+		}
+		err = l.CreateContainer(ctx, j.restoreAs, j.alias, img.Type)
+		if err != nil {
+			return err
+		}
+		j.created = true
+		return l.StartContainer(ctx, j.restoreAs)
+	})
+	if err != nil {
+		return err
+	}
+	j.log.WithField("spent", time.Since(t)).Info("Start container")
+
+	t = time.Now()
+	err = DeleteImage(ctx, j.host, j.alias)
+	if err != nil {
+		// The container is up, a leftover image is no reason to tear it down
+		j.log.Errorf("Restored container is running, but its image is left behind: %v", err)
+		return nil
+	}
+	j.imported = false
+	j.log.WithField("spent", time.Since(t)).Info("Delete image")
+	return nil
+}
+
+// finish rolls back a failed restore and adds its outcome to the report.
+func (j *restoreJob) finish(report *Report, err error) {
+	res := Result{
+		Host:      j.host,
+		Container: fmt.Sprintf("%s -> %s", j.source, j.restoreAs),
+		Warnings:  j.warnings,
+		Spent:     time.Since(j.start),
+	}
+	if err != nil {
+		j.log.Error(err)
+		res.Errors = append(res.Errors, err.Error())
+		j.rollback()
+	}
+	report.Add(res)
+}
+
+// skip records a restore that was not started because lxcer was asked to
+// stop.
+func (j *restoreJob) skip(report *Report) {
+	report.Add(Result{
+		Host:      j.host,
+		Container: fmt.Sprintf("%s -> %s", j.source, j.restoreAs),
+		Errors:    []string{"Not started, lxcer was interrupted"},
+	})
+}
+
+// rollback removes everything the job left behind: local archives, the
+// container it created and the image it imported.
+func (j *restoreJob) rollback() {
+	j.removeFiles()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	l, err := lxdClient(j.host)
+	if err != nil {
+		j.log.Error(err)
+		return
+	}
+	if j.created {
+		err = l.DeleteContainer(ctx, j.restoreAs)
+		if err != nil {
+			j.log.Error(err)
+		} else {
+			j.log.Infof("Roll back: delete container %s", j.restoreAs)
+		}
+	}
+	if j.imported {
+		err = DeleteImage(ctx, j.host, j.alias)
+		if err != nil {
+			j.log.Error(err)
+		} else {
+			j.log.Infof("Roll back: delete image %s", j.alias)
+		}
+	}
+}
+
+// removeFiles deletes the local archives of the job.
+func (j *restoreJob) removeFiles() {
+	for _, f := range []string{j.source.File(), j.source.Tar()} {
+		err := removeFile(f)
+		if err != nil && !os.IsNotExist(err) {
+			j.log.Error(err)
+		}
+	}
+}
+
+// restoreConcurrently fetches images one by one and starts containers from
+// the ones already fetched in the meantime.
+func restoreConcurrently(ctx context.Context, config *Config, report *Report) {
+	ch := restoreDecompressImport(ctx, config, report)
+	restoreStart(ctx, ch, report)
+}
+
+func restoreDecompressImport(ctx context.Context, config *Config, report *Report) chan *restoreJob {
+	ch := make(chan *restoreJob)
+	go func() {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source, restoreAs := range config.ContList {
+				j := newRestoreJob(config, source, restoreAs)
+				if interrupted() {
+					j.skip(report)
+					continue
+				}
+				err := j.fetch(ctx, config)
+				if err != nil {
+					j.finish(report, err)
+					continue
+				}
+				ch <- j
+			}
+		}()
+		wg.Wait()
+		close(ch)
+
+	}()
+	return ch
+}
+
+func restoreStart(ctx context.Context, ch chan *restoreJob, report *Report) {
+	for j := range ch {
+		j.finish(report, j.launch(ctx))
+	}
+}
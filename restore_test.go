@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreLaunchType(t *testing.T) {
+	for _, typ := range []string{"container", "virtual-machine", ""} {
+		t.Run(typ, func(t *testing.T) {
+			f, l := newFakeLXD(t)
+			useLXD(t, "h1", l)
+			j := newRestoreJob(&Config{Options: Options{RemoteHost: "h1"}}, "host-01/c1", "c2")
+			f.handle("GET /1.0/images/aliases/"+j.alias, lxdSync(map[string]string{"target": "fp1"}))
+			f.handle("GET /1.0/images/fp1", lxdSync(map[string]interface{}{
+				"fingerprint": "fp1", "type": typ, "properties": map[string]string{runProperty: "r1"},
+			}))
+			var req map[string]interface{}
+			f.handle("POST /1.0/instances", func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&req)
+				lxdSync(nil)(w, r)
+			})
+			f.handle("PUT /1.0/instances/c2/state", lxdSync(nil))
+			f.handle("DELETE /1.0/images/fp1", lxdSync(nil))
+
+			err := j.launch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := req["type"]
+			if typ == "" && ok {
+				t.Errorf("type = %v, want none", got)
+			}
+			if typ != "" && got != typ {
+				t.Errorf("type = %v, want %s", got, typ)
+			}
+			if req["name"] != "c2" {
+				t.Errorf("request = %v", req)
+			}
+		})
+	}
+}
+
+func TestRestoreDumpTimeout(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		lxdReply(w, http.StatusBadRequest, map[string]interface{}{
+			"type": "error", "error": "Invalid tarball", "error_code": 400,
+		})
+	})
+	useRunner(t, runnerFunc(func(ctx context.Context, c Command) ([]byte, error) {
+		switch {
+		case c.Name == "zstd":
+			_, err := io.Copy(c.Stdout, c.Stdin)
+			return nil, err
+		case c.Args[0] == "snapshots":
+			return []byte(snapshotsJSON), nil
+		case c.Args[0] == "ls":
+			return []byte(`{"type":"file","path":"/host-01/c1.tar.zst","struct_type":"node"}`), nil
+		}
+		// restic dump hangs on a backend that stopped answering
+		<-ctx.Done()
+		return nil, &CommandError{Command: c.String(), ExitCode: -1, Err: ctx.Err()}
+	}))
+
+	config := &Config{
+		Options:            Options{RemoteHost: "h1"},
+		Stream:             true,
+		RestoreResticRepos: []ResticRepo{{Path: "one"}},
+		StageTimeout:       map[string]time.Duration{"dump": 10 * time.Millisecond},
+	}
+	j := newRestoreJob(config, "host-01/c1", "c1")
+	err := j.fetch(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "Timed out after 10ms") {
+		t.Fatalf("err = %v, want the dump to time out", err)
+	}
+}
+
+// fetchRunner serves host-01/c1 from every repo. restic dump writes what
+// dumps holds for the repo, or fails with it if it is an error of restic.
+// zstd copies its input to its output, a dump that says corrupt breaks it
+// halfway through. dumped returns the repos dumped from so far.
+func fetchRunner(dumps map[string]string) (r CommandRunner, dumped func() []string) {
+	var (
+		mu    sync.Mutex
+		repos []string
+	)
+	r = runnerFunc(func(ctx context.Context, c Command) ([]byte, error) {
+		if c.Name == "zstd" {
+			if c.Stdin != nil {
+				_, err := io.Copy(c.Stdout, c.Stdin)
+				return nil, err
+			}
+			// zstd -d -T0 host-01/c1.tar.zst -o host-01/c1.tar
+			in, err := ioutil.ReadFile(c.Args[2])
+			if err != nil {
+				return nil, err
+			}
+			if string(in) == "corrupt" {
+				ioutil.WriteFile(c.Args[4], in[:3], 0600)
+				return nil, &CommandError{Command: c.String(), ExitCode: 1, Stderr: c.Args[2] + " : Decoding error (36) : Corrupted block detected"}
+			}
+			return nil, ioutil.WriteFile(c.Args[4], in, 0600)
+		}
+		switch c.Args[0] {
+		case "snapshots":
+			return []byte(snapshotsJSON), nil
+		case "ls":
+			return []byte(`{"type":"file","path":"/host-01/c1.tar.zst","struct_type":"node"}`), nil
+		}
+		repo := repoOf(c)
+		mu.Lock()
+		repos = append(repos, repo)
+		mu.Unlock()
+		if strings.HasPrefix(dumps[repo], "Fatal: ") {
+			return nil, &CommandError{Command: c.String(), ExitCode: 1, Stderr: dumps[repo]}
+		}
+		_, err := c.Stdout.Write([]byte(dumps[repo]))
+		return nil, err
+	})
+	return r, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, repos...)
+	}
+}
+
+// importLXD makes a fake LXD on h1 that takes every image it is sent and
+// keeps what it was sent.
+func importLXD(t *testing.T) (f *fakeLXD, imported func() []string) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	var (
+		mu     sync.Mutex
+		images []string
+	)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		images = append(images, string(body))
+		mu.Unlock()
+		lxdAsync("/1.0/operations/op1")(w, r)
+	})
+	f.handle("GET /1.0/operations/op1/wait", lxdOperationDone(lxdSuccess, "", map[string]string{"fingerprint": "fp1"}))
+	f.handle("POST /1.0/images/aliases", lxdSync(nil))
+	return f, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, images...)
+	}
+}
+
+// restoreConfig restores to h1 from repos, streamed or not.
+func restoreConfig(stream bool, repos ...string) *Config {
+	config := &Config{Options: Options{RemoteHost: "h1"}, Stream: stream}
+	for _, r := range repos {
+		config.RestoreResticRepos = append(config.RestoreResticRepos, ResticRepo{Path: r})
+	}
+	return config
+}
+
+// inTempDir runs the test in a directory of its own.
+func inTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxcer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+}
+
+func TestRestoreFetchNextRepo(t *testing.T) {
+	_, imported := importLXD(t)
+	r, dumped := fetchRunner(map[string]string{
+		"one":   "Fatal: unable to open repository",
+		"two":   "Fatal: pack 0123 is damaged",
+		"three": "tarball",
+		"four":  "tarball",
+	})
+	useRunner(t, r)
+
+	config := restoreConfig(true, "one", "two", "three", "four")
+	j := newRestoreJob(config, "host-01/c1", "c1")
+	err := j.fetch(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(dumped(), want) {
+		t.Errorf("dumped from %q, want %q", dumped(), want)
+	}
+	if got := imported(); len(got) == 0 || got[len(got)-1] != "tarball" {
+		t.Errorf("imported %q, want the tarball", got)
+	}
+	if !j.imported {
+		t.Error("imported image is not rolled back on failure")
+	}
+	if len(j.warnings) != 2 ||
+		!strings.HasPrefix(j.warnings[0], "one: ") || !strings.Contains(j.warnings[0], "unable to open repository") ||
+		!strings.HasPrefix(j.warnings[1], "two: ") || !strings.Contains(j.warnings[1], "is damaged") {
+		t.Errorf("warnings = %q", j.warnings)
+	}
+
+	report := &Report{}
+	j.finish(report, nil)
+	if len(report.Results) != 1 || !reflect.DeepEqual(report.Results[0].Warnings, j.warnings) {
+		t.Errorf("report = %+v", report.Results)
+	}
+}
+
+func TestRestoreFetchAllReposFail(t *testing.T) {
+	importLXD(t)
+	r, dumped := fetchRunner(map[string]string{
+		"one": "Fatal: unable to open repository",
+		"two": "Fatal: wrong password or no key found",
+	})
+	useRunner(t, r)
+
+	config := restoreConfig(true, "one", "two")
+	j := newRestoreJob(config, "host-01/c1", "c1")
+	err := j.fetch(context.Background(), config)
+	if err == nil {
+		t.Fatal("restore from no repo succeeded")
+	}
+	for _, want := range []string{"one: ", "unable to open repository", "two: ", "wrong password"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+	if len(dumped()) != 2 {
+		t.Errorf("dumped from %q, want both repos", dumped())
+	}
+}
+
+func TestRestoreFetchStopsOnLXDError(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		lxdReply(w, http.StatusBadRequest, map[string]interface{}{
+			"type": "error", "error": "Image with same fingerprint already exists", "error_code": 400,
+		})
+	})
+	r, dumped := fetchRunner(map[string]string{"one": "tarball", "two": "tarball"})
+	useRunner(t, r)
+
+	config := restoreConfig(true, "one", "two")
+	j := newRestoreJob(config, "host-01/c1", "c1")
+	err := j.fetch(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("err = %v, want the LXD error", err)
+	}
+	if want := []string{"one"}; !reflect.DeepEqual(dumped(), want) {
+		t.Errorf("dumped from %q, want %q", dumped(), want)
+	}
+}
+
+func TestRestoreFetchRemovesFiles(t *testing.T) {
+	inTempDir(t)
+	_, imported := importLXD(t)
+	r, _ := fetchRunner(map[string]string{"one": "corrupt", "two": "tarball"})
+	// The broken .tar of repo one is gone before repo two is dumped from
+	left := false
+	useRunner(t, runnerFunc(func(ctx context.Context, c Command) ([]byte, error) {
+		if c.Name == "restic" && c.Args[0] == "dump" && repoOf(c) == "two" {
+			_, err := os.Stat("host-01/c1.tar")
+			left = err == nil
+		}
+		return r.Run(ctx, c)
+	}))
+
+	config := restoreConfig(false, "one", "two")
+	j := newRestoreJob(config, "host-01/c1", "c1")
+	err := j.fetch(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left {
+		t.Error(".tar of repo one left behind")
+	}
+	if got := imported(); len(got) != 1 || got[0] != "tarball" {
+		t.Errorf("imported %q, want the tarball of repo two", got)
+	}
+	for _, f := range []string{"host-01/c1.tar.zst", "host-01/c1.tar"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", f)
+		}
+	}
+	if len(j.warnings) != 1 || !strings.Contains(j.warnings[0], "Corrupted block") {
+		t.Errorf("warnings = %q", j.warnings)
+	}
+}
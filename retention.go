@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// Retention tells how many snapshots of a container restic forget keeps.
+// Zero values keep nothing by that rule, a policy with no rule at all
+// keeps everything.
+type Retention struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepHourly  int `yaml:"keep_hourly"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+}
+
+func (p Retention) empty() bool {
+	return p == Retention{}
+}
+
+// args are the restic forget flags of the policy.
+func (p Retention) args() []string {
+	var args []string
+	for _, k := range []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", p.KeepLast},
+		{"--keep-hourly", p.KeepHourly},
+		{"--keep-daily", p.KeepDaily},
+		{"--keep-weekly", p.KeepWeekly},
+		{"--keep-monthly", p.KeepMonthly},
+		{"--keep-yearly", p.KeepYearly},
+	} {
+		if k.n > 0 {
+			args = append(args, k.flag, strconv.Itoa(k.n))
+		}
+	}
+	return args
+}
+
+// retention returns the policy for archive a in repo r: the one of the
+// container (as host/container or just container) wins over the one of the
+// repo, which wins over the global one.
+func (c *Config) retention(r ResticRepo, a Archive) Retention {
+	if p, ok := c.ContainerRetention[a.String()]; ok {
+		return p
+	}
+	if p, ok := c.ContainerRetention[a.Container]; ok {
+		return p
+	}
+	if r.Retention != nil {
+		return *r.Retention
+	}
+	return c.Retention
+}
+
+// forgetGroup is what restic forget --json reports for a group of
+// snapshots.
+type forgetGroup struct {
+	Keep   []resticSnapshot `json:"keep"`
+	Remove []resticSnapshot `json:"remove"`
+}
+
+// Forget applies policy p to the snapshots of archive a. Only snapshots
+// lxcer tagged are considered, all of them form a single group whatever
+// run they come from. With dryRun nothing is removed, the result tells
+// what would be.
+func (r *ResticRepo) Forget(ctx context.Context, a Archive, p Retention, dryRun bool) (forgetGroup, error) {
+	var g forgetGroup
+	args := []string{"forget", "--json",
+		"--host", a.Host,
+		"--tag", archiveTag + "," + tag(tagContainer, a.Container),
+		"--group-by", "host",
+	}
+	args = append(args, p.args()...)
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	out, err := r.run(ctx, args...)
+	if err != nil {
+		return g, err
+	}
+	var gg []forgetGroup
+	err = json.Unmarshal(out, &gg)
+	if err != nil {
+		return g, err
+	}
+	for _, x := range gg {
+		g.Keep = append(g.Keep, x.Keep...)
+		g.Remove = append(g.Remove, x.Remove...)
+	}
+	return g, nil
+}
+
+// archives returns every archive lxcer tagged in the repo.
+func (r *ResticRepo) archives(ctx context.Context) ([]Archive, error) {
+	ss, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		aa   []Archive
+		seen = map[string]bool{}
+	)
+	for _, s := range ss {
+		if !contains(s.Tags, archiveTag) {
+			continue
+		}
+		if _, ok := tagValue(s.Tags, tagContainer); !ok {
+			continue
+		}
+		for _, p := range s.Paths {
+			a, ok := snapshotArchive(s, p)
+			if !ok || seen[a.String()] {
+				continue
+			}
+			seen[a.String()] = true
+			aa = append(aa, Archive{Host: a.Host, Container: a.Container})
+		}
+	}
+	return aa, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConfigRetention(t *testing.T) {
+	global := Retention{KeepDaily: 7}
+	repo := Retention{KeepDaily: 14}
+	container := Retention{KeepLast: 3}
+	hostContainer := Retention{KeepLast: 1}
+	config := &Config{
+		Retention: global,
+		ContainerRetention: map[string]Retention{
+			"c1":         container,
+			"host-01/c1": hostContainer,
+			"c2":         container,
+		},
+	}
+	tests := []struct {
+		name    string
+		repo    ResticRepo
+		archive Archive
+		want    Retention
+	}{
+		{name: "host and container", repo: ResticRepo{Retention: &repo}, archive: Archive{Host: "host-01", Container: "c1"}, want: hostContainer},
+		{name: "container on another host", repo: ResticRepo{Retention: &repo}, archive: Archive{Host: "host-02", Container: "c1"}, want: container},
+		{name: "container", repo: ResticRepo{Retention: &repo}, archive: Archive{Host: "host-01", Container: "c2"}, want: container},
+		{name: "repo", repo: ResticRepo{Retention: &repo}, archive: Archive{Host: "host-01", Container: "c3"}, want: repo},
+		{name: "global", repo: ResticRepo{}, archive: Archive{Host: "host-01", Container: "c3"}, want: global},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := config.retention(tt.repo, tt.archive); got != tt.want {
+				t.Errorf("retention = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// forgetJSON is restic forget --json with a group that keeps everything,
+// which restic reports with remove set to null.
+const forgetJSON = `[
+  {"tags": ["lxcer", "container=c1"], "host": "host-01", "paths": null,
+   "keep": [{"id": "aaaa1111", "short_id": "aaaa1111"}, {"id": "bbbb2222", "short_id": "bbbb2222"}],
+   "remove": [{"id": "cccc3333", "short_id": "cccc3333"}],
+   "reasons": []},
+  {"tags": ["lxcer", "container=c1"], "host": "host-01", "paths": null,
+   "keep": [{"id": "dddd4444", "short_id": "dddd4444"}],
+   "remove": null,
+   "reasons": []}
+]`
+
+func TestResticRepoForget(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		f := &fakeRunner{respond: func(c Command) ([]byte, error) {
+			return []byte(forgetJSON), nil
+		}}
+		useRunner(t, f)
+
+		r := ResticRepo{Path: "one"}
+		g, err := r.Forget(context.Background(), Archive{Host: "host-01", Container: "c1"}, Retention{KeepLast: 2, KeepWeekly: 4}, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"forget", "--json",
+			"--host", "host-01",
+			"--tag", "lxcer,container=c1",
+			"--group-by", "host",
+			"--keep-last", "2", "--keep-weekly", "4",
+		}
+		if dryRun {
+			want = append(want, "--dry-run")
+		}
+		if len(f.commands) != 1 || !reflect.DeepEqual(f.commands[0].Args, want) {
+			t.Errorf("ran %+v, want %q", f.commands, want)
+		}
+
+		var keep, remove []string
+		for _, s := range g.Keep {
+			keep = append(keep, s.ID)
+		}
+		for _, s := range g.Remove {
+			remove = append(remove, s.ID)
+		}
+		if !reflect.DeepEqual(keep, []string{"aaaa1111", "bbbb2222", "dddd4444"}) || !reflect.DeepEqual(remove, []string{"cccc3333"}) {
+			t.Errorf("keep %q and remove %q", keep, remove)
+		}
+	}
+}
+
+func TestResticRepoForgetNothing(t *testing.T) {
+	useRunner(t, &fakeRunner{respond: func(c Command) ([]byte, error) {
+		// No snapshot of the archive left
+		return []byte("[]"), nil
+	}})
+	r := ResticRepo{Path: "one"}
+	g, err := r.Forget(context.Background(), Archive{Host: "host-01", Container: "c1"}, Retention{KeepLast: 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Keep) != 0 || len(g.Remove) != 0 {
+		t.Errorf("forget = %+v", g)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy says how often a step is tried before a transient error
+// fails it, and how long to wait in between. The wait starts at Backoff and
+// doubles with every attempt up to MaxBackoff, give or take Jitter (0.2 is
+// ±20%) so that workers that failed together do not retry together.
+// Jitter is a pointer so that 0 can turn it off.
+type RetryPolicy struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Jitter     *float64      `yaml:"jitter"`
+}
+
+var defaultJitter = 0.2
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    10 * time.Second,
+	MaxBackoff: 2 * time.Minute,
+	Jitter:     &defaultJitter,
+}
+
+// or fills the unset fields of the policy from d.
+func (p RetryPolicy) or(d RetryPolicy) RetryPolicy {
+	if p.Attempts == 0 {
+		p.Attempts = d.Attempts
+	}
+	if p.Backoff == 0 {
+		p.Backoff = d.Backoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.Jitter == nil {
+		p.Jitter = d.Jitter
+	}
+	return p
+}
+
+// retryPolicy is the policy of the stage with the given key (publish,
+// export, compress, upload, stream, copy or delete): stage_retry falls back
+// to retry, which falls back to the defaults.
+func (c *Config) retryPolicy(stage string) RetryPolicy {
+	return c.StageRetry[stage].or(c.Retry).or(defaultRetryPolicy)
+}
+
+// wait is how long to wait before the given retry, the first being 1.
+func (p RetryPolicy) wait(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter != nil && *p.Jitter > 0 {
+		d += time.Duration(float64(d) * *p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// do runs f until it succeeds, fails with a permanent error, runs out of
+// attempts or ctx is done. Every retry is logged and returned as "what:
+// error", so that it can be shown in the report.
+func (p RetryPolicy) do(ctx context.Context, l *log.Entry, what string, f func() error) ([]string, error) {
+	var retries []string
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.Attempts || ctx.Err() != nil || !transient(err) {
+			return retries, err
+		}
+		d := p.wait(attempt)
+		l.WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"wait":    d.Round(time.Second),
+		}).Warnf("%s failed with a transient error, retrying: %v", what, err)
+		retries = append(retries, fmt.Sprintf("%s: %v", what, err))
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return retries, err
+		}
+	}
+}
+
+// transientErrors are what LXD, restic and the backends restic talks to
+// say about failures that may well be gone on the next attempt.
+var transientErrors = []string{
+	"unable to create lock",
+	"repository is already locked",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"timeout",
+	"timed out",
+	"deadline exceeded",
+	"temporary failure",
+	"try again",
+	"too many requests",
+	"service unavailable",
+	"bad gateway",
+	"gateway timeout",
+	"internal server error",
+	"unexpected eof",
+	"server misbehaving",
+	"tls handshake",
+	"device or resource busy",
+}
+
+// resticLockFailed is the exit code of restic 0.17 and later when the
+// repo is locked by someone else.
+const resticLockFailed = 11
+
+// transient tells whether err is worth another try: timeouts, lost
+// connections, overloaded servers and locked repos are, bad configs,
+// missing containers, wrong passwords, full disks and cancelled runs are
+// not.
+func transient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var re *repoErrors
+	if errors.As(err, &re) {
+		return re.transient()
+	}
+
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		if ce.ExitCode == resticLockFailed && strings.HasPrefix(ce.Command, "restic ") {
+			return true
+		}
+		if ce.ExitCode < 0 && ce.Stderr == "" {
+			// the program could not be started at all
+			return false
+		}
+		return matchesTransient(ce.Stderr)
+	}
+
+	var le *LXDError
+	if errors.As(err, &le) {
+		switch le.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		// LXD answers most failures with a 500, whether a full storage
+		// pool or a lost connection, only the message tells them apart
+		return matchesTransient(le.Message)
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return matchesTransient(err.Error())
+}
+
+// permanentErrors win over transientErrors: a full disk stays full
+// however often it is tried again.
+var permanentErrors = []string{
+	"no space left on device",
+	"quota exceeded",
+	"read-only file system",
+	"permission denied",
+}
+
+func matchesTransient(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range permanentErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
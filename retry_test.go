@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "lxd unavailable", err: &LXDError{StatusCode: 503, Message: "503 Service Unavailable"}, want: true},
+		{name: "lxd full pool", err: &LXDError{StatusCode: 500, Message: "Failed creating instance from image: write /var/lib/lxd/images/fp1: no space left on device"}},
+		{name: "lxd internal", err: &LXDError{StatusCode: 500, Message: "Storage pool \"default\" is unavailable on this server"}},
+		{name: "lxd lost connection", err: &LXDError{StatusCode: 500, Message: "Failed to fetch: read tcp 10.0.0.1:8443: connection reset by peer"}, want: true},
+		{name: "proxy", err: &LXDError{StatusCode: 500, Message: "500 Internal Server Error"}, want: true},
+		{name: "lxd forbidden", err: &LXDError{StatusCode: 403, Message: "not authorized"}},
+		{name: "cancelled", err: fmt.Errorf("Backup to one: %w", context.Canceled)},
+		{name: "timed out", err: fmt.Errorf("Timed out after 1m0s: %w", context.DeadlineExceeded), want: true},
+		{name: "restic locked", err: &CommandError{Command: "restic backup --json", ExitCode: resticLockFailed, Stderr: "Fatal: unable to create lock"}, want: true},
+		{name: "restic locked quietly", err: &CommandError{Command: "restic backup --json", ExitCode: resticLockFailed}, want: true},
+		{name: "zstd exit 11", err: &CommandError{Command: "zstd -T0", ExitCode: 11}},
+		{name: "not started", err: &CommandError{Command: "restic snapshots", ExitCode: -1, Err: errors.New(`exec: "restic": executable file not found in $PATH`)}},
+		{name: "restic backend", err: &CommandError{Command: "restic backup", ExitCode: 1, Stderr: "Save(<data/0123>) returned error, retrying after 1s: 500 Internal Server Error"}, want: true},
+		{name: "restic wrong password", err: &CommandError{Command: "restic backup", ExitCode: 1, Stderr: "Fatal: wrong password or no key found"}},
+		{name: "restic full disk", err: &CommandError{Command: "restic restore", ExitCode: 1, Stderr: "write host-01/c1.tar.zst: no space left on device"}},
+		{name: "one repo transient", err: &repoErrors{
+			repos: []string{"one", "two"},
+			errs: []error{
+				&CommandError{Command: "restic backup", ExitCode: 1, Stderr: "Fatal: wrong password or no key found"},
+				&CommandError{Command: "restic backup", ExitCode: resticLockFailed},
+			},
+		}, want: true},
+		{name: "no repo transient", err: &repoErrors{
+			repos: []string{"one"},
+			errs:  []error{&CommandError{Command: "restic backup", ExitCode: 1, Stderr: "Fatal: wrong password or no key found"}},
+		}},
+		{name: "network", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, want: true},
+		{name: "short read", err: fmt.Errorf("export: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "unknown", err: errors.New("Container c1 does not exist on host h1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transient(tt.err); got != tt.want {
+				t.Errorf("transient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyOr(t *testing.T) {
+	var c Config
+	err := yaml.Unmarshal([]byte("retry:\n  attempts: 5\nstage_retry:\n  upload:\n    jitter: 0\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := c.retryPolicy("upload")
+	if upload.Attempts != 5 || upload.Backoff != defaultRetryPolicy.Backoff || upload.Jitter == nil || *upload.Jitter != 0 {
+		t.Errorf("upload = %+v, want 5 attempts, default backoff and no jitter", upload)
+	}
+	if copy := c.retryPolicy("copy"); copy.Jitter == nil || *copy.Jitter != defaultJitter {
+		t.Errorf("copy = %+v, want the default jitter", copy)
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	noJitter := 0.0
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: &noJitter}
+	for retry, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		20: 10 * time.Second,
+	} {
+		if got := p.wait(retry); got != want {
+			t.Errorf("wait(%d) = %s, want %s", retry, got, want)
+		}
+	}
+
+	jitter := 0.5
+	p.Jitter = &jitter
+	for i := 0; i < 100; i++ {
+		got := p.wait(1)
+		if got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("wait(1) = %s, want 1s ± 50%%", got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	locked := &CommandError{Command: "restic backup", ExitCode: resticLockFailed}
+	wrong := &CommandError{Command: "restic backup", ExitCode: 1, Stderr: "Fatal: wrong password or no key found"}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		errs    []error
+		calls   int
+		retries int
+		wantErr error
+	}{
+		{name: "first time", errs: []error{nil}, calls: 1},
+		{name: "after a transient error", errs: []error{locked, nil}, calls: 2, retries: 1},
+		{name: "permanent", errs: []error{wrong, nil}, calls: 1, wantErr: wrong},
+		{name: "out of attempts", errs: []error{locked, locked, locked, nil}, calls: 3, retries: 2, wantErr: locked},
+		{name: "cancelled", ctx: cancelled, errs: []error{locked, nil}, calls: 1, wantErr: locked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			p := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+			calls := 0
+			retries, err := p.do(ctx, log.WithField("test", tt.name), "Backup to one", func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.calls || len(retries) != tt.retries {
+				t.Errorf("%d calls and retries %q, want %d and %d", calls, retries, tt.calls, tt.retries)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Snapshots and image aliases lxcer creates are prefixed with ownPrefix and
+// images carry the runProperty, lxcer never deletes anything without them.
+const (
+	ownPrefix   = "lxcer-"
+	runProperty = "lxcer.run"
+)
+
+// runID identifies the current run in the names of everything it creates,
+// so that concurrent runs never step on each other.
+var runID = newRunID()
+
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+}
+
+// runSnapshot is the name of the snapshot this run takes of every container.
+func runSnapshot() string {
+	return ownPrefix + runID
+}
+
+// runAlias is the alias of the image this run creates for a container of
+// host.
+func runAlias(host, container string) string {
+	return fmt.Sprintf("%s%s-%s-%s", ownPrefix, runID, host, container)
+}
+
+// imageProperties mark an image as created by this run.
+func imageProperties(host, container string) map[string]string {
+	return map[string]string{
+		runProperty:       runID,
+		"lxcer.host":      host,
+		"lxcer.container": container,
+	}
+}
+
+func ownSnapshot(name string) bool {
+	return strings.HasPrefix(name, ownPrefix)
+}
+
+// runStarted is when the run with id started, false for IDs lxcer did not
+// hand out.
+func runStarted(id string) (time.Time, bool) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102T150405Z", id[:i])
+	return t, err == nil
+}
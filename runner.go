@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Command describes a single invocation of an external program.
+type Command struct {
+	Name string
+	Args []string
+	// Env is appended to the environment of lxcer itself.
+	Env   []string
+	Stdin io.Reader
+	// Stdout receives the output of the program. When nil, the output is
+	// collected and returned by Run.
+	Stdout io.Writer
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// CommandRunner runs external programs. Every zstd and restic call goes
+// through it, so it can be replaced with a fake in tests or wrapped to
+// trace every command in one place. The program is stopped once ctx is
+// done.
+type CommandRunner interface {
+	Run(ctx context.Context, cmd Command) ([]byte, error)
+}
+
+// CommandError is returned by a CommandRunner when a program could not be
+// started, exited with a non-zero code or was killed because its context
+// was done. In the latter case Err is the error of the context.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s: %s", e.Command, e.Stderr)
+	}
+	return fmt.Sprintf("%s: %v", e.Command, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+var runner CommandRunner = execRunner{}
+
+// execRunner runs programs with os/exec.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, c Command) ([]byte, error) {
+	var (
+		Stdout bytes.Buffer
+		Stderr bytes.Buffer
+	)
+
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	// Signals to lxcer are not for its children, lxcer stops them itself
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = &Stdout
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
+	cmd.Stderr = &Stderr
+
+	var stdin io.WriteCloser
+	if c.Stdin != nil {
+		var err error
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		exited := stopOnDone(ctx, cmd.Process)
+		if stdin != nil {
+			go feedStdin(cmd, stdin, c.Stdin)
+		}
+		err = cmd.Wait()
+		exited()
+	}
+	log.WithFields(log.Fields{
+		"cmd":   c.String(),
+		"spent": time.Since(t),
+	}).Debug("Run command")
+	if err != nil {
+		e := &CommandError{
+			Command:  c.String(),
+			ExitCode: -1,
+			Stderr:   strings.TrimSpace(Stderr.String()),
+			Err:      err,
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			e.ExitCode = ee.ExitCode()
+		}
+		if ctx.Err() != nil {
+			// Whatever it printed before it was killed is beside the point
+			e.Stderr = ""
+			e.Err = ctx.Err()
+		}
+		return nil, e
+	}
+	return Stdout.Bytes(), nil
+}
+
+// killDelay is how long a program has to exit after SIGINT before it is
+// killed. restic removes its locks when interrupted.
+const killDelay = 10 * time.Second
+
+// stopOnDone interrupts the program once ctx is done and kills it if it is
+// still around after killDelay. The signals go to its whole process group,
+// so that whatever it started itself, e.g. rclone, stops too. The returned
+// func is to be called once the program exited.
+func stopOnDone(ctx context.Context, p *os.Process) func() {
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-p.Pid, syscall.SIGINT)
+		case <-exited:
+			return
+		}
+		select {
+		case <-time.After(killDelay):
+			syscall.Kill(-p.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	return func() { close(exited) }
+}
+
+// feedStdin copies r to the program. If reading r fails, the program is
+// killed before its stdin is closed, so that it never mistakes a broken
+// stream for a complete one. It stops reading r once the program is gone.
+func feedStdin(cmd *exec.Cmd, stdin io.WriteCloser, r io.Reader) {
+	defer stdin.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := stdin.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			return
+		}
+	}
+}
+
+func zstd(ctx context.Context, args ...string) ([]byte, error) {
+	return runner.Run(ctx, Command{Name: "zstd", Args: args})
+}
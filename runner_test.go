@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner stands in for restic and zstd. respond answers every command,
+// the commands are kept for the test to look at.
+type fakeRunner struct {
+	mu       sync.Mutex
+	commands []Command
+	respond  func(c Command) ([]byte, error)
+}
+
+func (f *fakeRunner) Run(ctx context.Context, c Command) ([]byte, error) {
+	if c.Stdin != nil {
+		io.Copy(ioutil.Discard, c.Stdin)
+	}
+	f.mu.Lock()
+	f.commands = append(f.commands, c)
+	f.mu.Unlock()
+	if f.respond == nil {
+		return nil, nil
+	}
+	return f.respond(c)
+}
+
+// runnerFunc runs every command with itself, for tests that need to play
+// with the pipes.
+type runnerFunc func(ctx context.Context, c Command) ([]byte, error)
+
+func (f runnerFunc) Run(ctx context.Context, c Command) ([]byte, error) {
+	return f(ctx, c)
+}
+
+// useRunner makes r the runner of the test.
+func useRunner(t *testing.T, r CommandRunner) {
+	old := runner
+	runner = r
+	t.Cleanup(func() { runner = old })
+}
+
+// repoOf is the RESTIC_REPOSITORY the command runs against.
+func repoOf(c Command) string {
+	for _, e := range c.Env {
+		if strings.HasPrefix(e, "RESTIC_REPOSITORY=") {
+			return strings.TrimPrefix(e, "RESTIC_REPOSITORY=")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultGracePeriod fits into the 90 seconds systemd waits by default
+// before it kills a service that was asked to stop.
+const defaultGracePeriod = time.Minute
+
+// stopping is closed once lxcer is asked to stop. No new containers are
+// started from then on, the ones under way get the grace period to finish.
+var stopping = make(chan struct{})
+
+// interrupted tells whether lxcer was asked to stop.
+func interrupted() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Config) gracePeriod() time.Duration {
+	if c.GracePeriod == 0 {
+		return defaultGracePeriod
+	}
+	return c.GracePeriod
+}
+
+// handleSignals stops lxcer on SIGINT and SIGTERM. The work under way is
+// cancelled once the grace period is over, or right away on a second
+// signal. Commands that do not stop gracefully are cancelled on the first.
+// Once the work is cancelled, the next signal kills lxcer as usual, e.g.
+// when the rollback hangs.
+func handleSignals(cancel context.CancelFunc, graceful bool, grace time.Duration) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+
+	sig := <-ch
+	close(stopping)
+	if !graceful {
+		log.Warnf("Got %s, stopping", sig)
+		cancel()
+		return
+	}
+	log.Warnf("Got %s, starting no new containers and giving the running ones %s to finish", sig, grace)
+
+	select {
+	case <-time.After(grace):
+		log.Warn("Grace period is over, cancelling what is still running")
+	case sig = <-ch:
+		log.Warnf("Got %s again, cancelling what is still running", sig)
+	}
+	cancel()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultStaleAfter leaves the snapshots and images of runs that may still
+// be under way alone, even on slow nights.
+const defaultStaleAfter = 24 * time.Hour
+
+func (c *Config) staleAfter() time.Duration {
+	if c.StaleAfter == 0 {
+		return defaultStaleAfter
+	}
+	return c.StaleAfter
+}
+
+// removeStale deletes the snapshots and images that runs started before
+// before left on the hosts, as they crashed or were killed before they
+// could clean up. Failures are logged, the backup goes on regardless.
+func removeStale(ctx context.Context, hosts []Host, before time.Time) {
+	for _, h := range hosts {
+		err := h.removeStale(ctx, before)
+		if err != nil {
+			log.WithField("host", h.Name).Errorf("Cannot remove stale snapshots and images: %v", err)
+		}
+	}
+}
+
+// stale tells whether the run with id is not this one and started before
+// before.
+func stale(id string, before time.Time) bool {
+	started, ok := runStarted(id)
+	return ok && id != runID && started.Before(before)
+}
+
+func (h *Host) removeStale(ctx context.Context, before time.Time) error {
+	l, err := lxdClient(h.Name)
+	if err != nil {
+		return err
+	}
+
+	cc, err := l.Containers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range cc {
+		c.Host = h.Name
+		for _, s := range c.Snapshots {
+			if !ownSnapshot(s.Name) || !stale(s.Name[len(ownPrefix):], before) {
+				continue
+			}
+			t := time.Now()
+			log := log.WithFields(log.Fields{
+				"host":      h.Name,
+				"container": c.Name,
+			})
+			err = c.DeleteSnapshot(ctx, s.Name)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			log.WithField("spent", time.Since(t)).Infof("Delete stale snapshot %s", s.Name)
+		}
+	}
+
+	images, err := l.Images(ctx)
+	if err != nil {
+		return err
+	}
+	for _, i := range images {
+		if !i.Own() || !stale(i.Properties[runProperty], before) {
+			continue
+		}
+		t := time.Now()
+		log := log.WithField("host", h.Name)
+		err = l.DeleteImage(ctx, i.Fingerprint)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		log.WithField("spent", time.Since(t)).Infof("Delete stale image %s", i.Fingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveStale(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	old := "20240101T020000Z-aaaaaa"
+	recent := time.Now().UTC().Format("20060102T150405Z") + "-bbbbbb"
+	f.handle("GET /1.0/instances", lxdSync([]map[string]interface{}{
+		{"name": "c1", "snapshots": []map[string]string{
+			{"name": ownPrefix + old},
+			{"name": ownPrefix + recent},
+			{"name": ownPrefix + runID},
+			{"name": "before-upgrade"},
+		}},
+	}))
+	f.handle("GET /1.0/images", lxdSync([]map[string]interface{}{
+		{"fingerprint": "fp-old", "properties": map[string]string{runProperty: old}},
+		{"fingerprint": "fp-recent", "properties": map[string]string{runProperty: recent}},
+		{"fingerprint": "fp-run", "properties": map[string]string{runProperty: runID}},
+		{"fingerprint": "fp-ubuntu", "properties": map[string]string{"os": "ubuntu"}},
+	}))
+	f.handle("DELETE /1.0/instances/c1/snapshots/"+ownPrefix+old, lxdSync(nil))
+	f.handle("DELETE /1.0/images/fp-old", lxdSync(nil))
+
+	removeStale(context.Background(), []Host{toHost("h1")}, time.Now().Add(-time.Hour))
+
+	want := []string{
+		"DELETE /1.0/instances/c1/snapshots/" + ownPrefix + old,
+		"DELETE /1.0/images/fp-old",
+	}
+	var deleted []string
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "DELETE ") {
+			deleted = append(deleted, r)
+		}
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %q, want %q", deleted, want)
+	}
+}
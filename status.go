@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Status prints the containers a backup would pick on every host and the
+// state of every restic repo, without changing anything.
+func Status(ctx context.Context, config *Config) {
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "HOST\tCONTAINERS\tRUNNING\tTO BACK UP\tERROR")
+	for _, h := range selectHosts(config) {
+		err := h.GetContainers(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%v\n", h.Name, err)
+			failed = true
+			continue
+		}
+		running := 0
+		for _, c := range h.Containers {
+			if c.StatusCode == StatusRunning {
+				running++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", h.Name, len(h.Containers), running, len(filterContainers(h.Containers, config.Blacklist)))
+	}
+
+	w.Flush()
+	fmt.Println()
+
+	fmt.Fprintln(w, "REPO\tSNAPSHOTS\tLATEST\tERROR")
+	for _, r := range config.resticRepos() {
+		ss, err := r.Snapshots(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t%v\n", r.Path, err)
+			failed = true
+			continue
+		}
+		latest := "-"
+		var lt time.Time
+		for _, s := range ss {
+			if s.Time.After(lt) {
+				lt = s.Time
+				latest = s.Time.Format(time.RFC3339)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t\n", r.Path, len(ss), latest)
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
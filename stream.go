@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// errPipeClosed is what a stage of a stream sees when the next one is done
+// reading from it.
+var errPipeClosed = errors.New("the other end of the stream went away")
+
+// StreamToRepos backs the published image up without touching the local
+// disk: the export is piped through zstd straight into `restic backup
+// --stdin` of every repo. A repo that fails is dropped from the stream, the
+// others carry on. Every repo is recorded for the quorum. The error is
+// either what broke the export, or a *repoErrors naming the repos that
+// failed.
+func (c *Container) StreamToRepos(ctx context.Context, repos []ResticRepo) error {
+	if len(repos) == 0 {
+		return errors.New("No restic repos to stream to")
+	}
+	l, err := c.lxd()
+	if err != nil {
+		return err
+	}
+
+	exportR, exportW := io.Pipe()
+	exportErr := make(chan error, 1)
+	go func() {
+		err := l.ExportImage(ctx, c.alias(), exportW)
+		exportW.CloseWithError(err)
+		exportErr <- err
+	}()
+
+	var (
+		wg    sync.WaitGroup
+		out   = &fanOut{}
+		pipes []*io.PipeWriter
+		errs  = make([]error, len(repos))
+		sums  = make([]backupSummary, len(repos))
+		a     = c.archive()
+	)
+	for i, r := range repos {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+		out.ww = append(out.ww, pw)
+
+		wg.Add(1)
+		go func(i int, r ResticRepo) {
+			defer wg.Done()
+			sums[i], errs[i] = r.BackupStdin(ctx, a, pr)
+			// Unblocks the fan-out if restic gave up before reading it all
+			pr.CloseWithError(fmt.Errorf("restic backup to %s exited", r.Path))
+		}(i, r)
+	}
+	out.errs = make([]error, len(out.ww))
+
+	// zstd -T0 --rsyncable -c < export > restic
+	_, zerr := runner.Run(ctx, Command{
+		Name:   "zstd",
+		Args:   []string{"-T0", "--rsyncable", "-c"},
+		Stdin:  exportR,
+		Stdout: out,
+	})
+	exportR.CloseWithError(errPipeClosed)
+	err = rootCause(<-exportErr, zerr)
+
+	// A nil error hands restic a regular end of stream, anything else
+	// kills it before it can save a truncated snapshot.
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+
+	c.recordUploads(repos, sums, errs)
+	// zstd breaks as well once restic went away in every repo
+	if err != nil && !out.dead() {
+		return err
+	}
+	re := &repoErrors{}
+	for i, err := range errs {
+		if err != nil {
+			re.repos = append(re.repos, repos[i].Path)
+			re.errs = append(re.errs, err)
+		}
+	}
+	if len(re.errs) > 0 {
+		return re
+	}
+	return err
+}
+
+// repoErrors are the repos a stream did not reach and why.
+type repoErrors struct {
+	repos []string
+	errs  []error
+}
+
+func (e *repoErrors) Error() string {
+	var failed []string
+	for i, err := range e.errs {
+		failed = append(failed, fmt.Sprintf("%s: %v", e.repos[i], err))
+	}
+	return strings.Join(failed, "; ")
+}
+
+// transient tells whether any of the repos is worth another try.
+func (e *repoErrors) transient() bool {
+	for _, err := range e.errs {
+		if transient(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// fanOut copies everything written to it to all writers that have not
+// failed yet, and only fails once every one of them has.
+type fanOut struct {
+	ww   []io.Writer
+	errs []error
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range f.ww {
+		if f.errs[i] != nil {
+			continue
+		}
+		_, err := w.Write(p)
+		if err != nil {
+			f.errs[i] = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errors.New("every restic repo stopped reading the stream")
+	}
+	return len(p), nil
+}
+
+// dead tells whether every writer has failed.
+func (f *fanOut) dead() bool {
+	for _, err := range f.errs {
+		if err == nil {
+			return false
+		}
+	}
+	return len(f.errs) > 0
+}
+
+// StreamRestore imports the latest archive source from the repo as image
+// alias on host without staging anything on disk:
+// restic dump | zstd -d | LXD image import.
+func StreamRestore(ctx context.Context, r ResticRepo, host string, source Archive, restoreAs, alias string) error {
+	l, err := lxdClient(host)
+	if err != nil {
+		return err
+	}
+
+	// Each stage notes when it is done, so the one before it can tell its
+	// error is just the pipe it wrote to going away
+	zstdDone := make(chan struct{})
+	importDone := make(chan struct{})
+
+	dumpR, dumpW := io.Pipe()
+	dumpErr := make(chan error, 1)
+	go func() {
+		err := r.Dump(ctx, source, dumpW)
+		dumpErr <- consequence(err, zstdDone)
+		dumpW.CloseWithError(err)
+	}()
+
+	tarR, tarW := io.Pipe()
+	zstdErr := make(chan error, 1)
+	go func() {
+		// zstd -d -T0 -c < dump > import
+		_, err := runner.Run(ctx, Command{
+			Name:   "zstd",
+			Args:   []string{"-d", "-T0", "-c"},
+			Stdin:  dumpR,
+			Stdout: tarW,
+		})
+		close(zstdDone)
+		dumpR.CloseWithError(errPipeClosed)
+		zstdErr <- consequence(err, importDone)
+		// A failed decompression aborts the upload instead of ending it
+		tarW.CloseWithError(err)
+	}()
+
+	created.add(imageArtifact(host, alias))
+	_, err = l.ImportImage(ctx, tarR, alias, imageProperties(host, restoreAs))
+	close(importDone)
+	tarR.CloseWithError(errPipeClosed)
+
+	return rootCause(<-dumpErr, <-zstdErr, err)
+}
+
+// consequence marks err as caused by the pipe it wrote to going away when
+// the stage reading from that pipe is already done. A program writing into
+// a closed pipe dies of SIGPIPE, which says nothing about what went wrong.
+func consequence(err error, reader <-chan struct{}) error {
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-reader:
+		return &pipeClosedError{err}
+	default:
+		return err
+	}
+}
+
+// pipeClosedError is an error of a stream stage whose reader went away
+// before it.
+type pipeClosedError struct {
+	err error
+}
+
+func (e *pipeClosedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pipeClosedError) Is(target error) bool {
+	return target == errPipeClosed
+}
+
+func (e *pipeClosedError) Unwrap() error {
+	return e.err
+}
+
+// rootCause returns the first error that is not just a consequence of
+// another part of the stream going away.
+func rootCause(errs ...error) error {
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, errPipeClosed) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
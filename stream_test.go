@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamRunner passes the stream through zstd untouched and lets restic
+// fail with the error in failing for its repo, before reading anything.
+func streamRunner(failing map[string]string) CommandRunner {
+	return runnerFunc(func(ctx context.Context, c Command) ([]byte, error) {
+		if c.Name == "zstd" {
+			_, err := io.Copy(c.Stdout, c.Stdin)
+			if err != nil {
+				return nil, &CommandError{Command: c.String(), ExitCode: -1, Err: err}
+			}
+			return nil, nil
+		}
+		if msg, ok := failing[repoOf(c)]; ok {
+			return nil, &CommandError{Command: c.String(), ExitCode: 1, Stderr: msg}
+		}
+		io.Copy(ioutil.Discard, c.Stdin)
+		return []byte(`{"message_type":"summary","snapshot_id":"0123456789abcdef"}`), nil
+	})
+}
+
+func streamContainer(t *testing.T) *Container {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	c := &Container{Name: "c1", Host: "h1"}
+	f.handle("GET /1.0/images/aliases/"+c.alias(), lxdSync(map[string]string{"target": "fp1"}))
+	f.handle("GET /1.0/images/fp1/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1<<20)))
+	})
+	return c
+}
+
+func TestStreamToReposPartial(t *testing.T) {
+	c := streamContainer(t)
+	useRunner(t, streamRunner(map[string]string{"two": "Fatal: unable to open repository"}))
+
+	err := c.StreamToRepos(context.Background(), []ResticRepo{{Path: "one"}, {Path: "two"}})
+	var re *repoErrors
+	if !errors.As(err, &re) || !reflect.DeepEqual(re.repos, []string{"two"}) {
+		t.Fatalf("err = %v, want repo two to fail", err)
+	}
+	if len(c.Uploads) != 1 || c.Uploads[0].Repo != "one" {
+		t.Errorf("Uploads = %+v", c.Uploads)
+	}
+	if len(c.UploadErrors) != 1 || !strings.Contains(c.UploadErrors[0], "unable to open repository") {
+		t.Errorf("UploadErrors = %q", c.UploadErrors)
+	}
+}
+
+func TestStreamToReposAllFailed(t *testing.T) {
+	c := streamContainer(t)
+	useRunner(t, streamRunner(map[string]string{
+		"one": "Fatal: unable to open repository",
+		"two": "Fatal: wrong password",
+	}))
+
+	err := c.StreamToRepos(context.Background(), []ResticRepo{{Path: "one"}, {Path: "two"}})
+	if err == nil {
+		t.Fatal("stream to no repo succeeded")
+	}
+	// The restic errors, not zstd losing its reader
+	for _, want := range []string{"unable to open repository", "wrong password"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+	if len(c.UploadErrors) != 2 {
+		t.Errorf("UploadErrors = %q", c.UploadErrors)
+	}
+}
+
+func TestStreamStageRetriesRepos(t *testing.T) {
+	c := streamContainer(t)
+	var (
+		mu      sync.Mutex
+		streams []string
+	)
+	locked := true
+	useRunner(t, runnerFunc(func(ctx context.Context, cmd Command) ([]byte, error) {
+		if cmd.Name == "zstd" {
+			_, err := io.Copy(cmd.Stdout, cmd.Stdin)
+			return nil, err
+		}
+		repo := repoOf(cmd)
+		mu.Lock()
+		streams = append(streams, repo)
+		wasLocked := repo == "two" && locked
+		if wasLocked {
+			locked = false
+		}
+		mu.Unlock()
+		if wasLocked {
+			return nil, &CommandError{Command: cmd.String(), ExitCode: 1, Stderr: "Fatal: unable to create lock in backend: repository is already locked"}
+		}
+		if repo == "three" {
+			return nil, &CommandError{Command: cmd.String(), ExitCode: 1, Stderr: "Fatal: wrong password or no key found"}
+		}
+		io.Copy(ioutil.Discard, cmd.Stdin)
+		return []byte(`{"message_type":"summary","snapshot_id":"0123456789abcdef"}`), nil
+	}))
+
+	repos := []ResticRepo{{Path: "one"}, {Path: "two"}, {Path: "three"}}
+	do := streamStage(repos, nil, RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, 0)
+	err := do(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one is not streamed to again, three fails for good but only after
+	// the attempt two needed
+	sort.Strings(streams)
+	if want := []string{"one", "three", "three", "two", "two"}; !reflect.DeepEqual(streams, want) {
+		t.Errorf("streamed to %q, want %q", streams, want)
+	}
+	if len(c.Uploads) != 2 || len(c.Retries) != 1 {
+		t.Errorf("Uploads = %+v, Retries = %q", c.Uploads, c.Retries)
+	}
+	if len(c.UploadErrors) != 1 || !strings.HasPrefix(c.UploadErrors[0], "three: ") {
+		t.Errorf("UploadErrors = %q", c.UploadErrors)
+	}
+}
+
+// restoreRunner answers restic snapshots and dumps a megabyte, or fails the
+// dump halfway with dumpErr. zstd passes the stream through.
+func restoreRunner(dumpErr string) CommandRunner {
+	return runnerFunc(func(ctx context.Context, c Command) ([]byte, error) {
+		broken := &CommandError{Command: c.String(), ExitCode: -1, Err: errors.New("signal: broken pipe")}
+		switch {
+		case c.Name == "zstd":
+			_, err := io.Copy(c.Stdout, c.Stdin)
+			if err != nil {
+				return nil, broken
+			}
+			return nil, nil
+		case c.Args[0] == "snapshots":
+			return []byte(snapshotsJSON), nil
+		case c.Args[0] == "ls":
+			return []byte(`{"type":"file","path":"/host-01/c1.tar.zst","struct_type":"node"}`), nil
+		}
+		chunk := []byte(strings.Repeat("x", 1<<10))
+		for i := 0; i < 1<<10; i++ {
+			if dumpErr != "" && i == 1<<9 {
+				return nil, &CommandError{Command: c.String(), ExitCode: 1, Stderr: dumpErr}
+			}
+			_, err := c.Stdout.Write(chunk)
+			if err != nil {
+				return nil, broken
+			}
+		}
+		return nil, nil
+	})
+}
+
+func TestStreamRestoreImportRejected(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(ioutil.Discard, r.Body, 1<<10)
+		lxdReply(w, http.StatusBadRequest, map[string]interface{}{
+			"type": "error", "error": "Image with same fingerprint already exists", "error_code": 400,
+		})
+	})
+	useRunner(t, restoreRunner(""))
+
+	err := StreamRestore(context.Background(), ResticRepo{Path: "one"}, "h1", Archive{Host: "host-01", Container: "c1"}, "c1", "a1")
+	var e *LXDError
+	if !errors.As(err, &e) {
+		t.Fatalf("err = %v, want the LXD error", err)
+	}
+}
+
+func TestStreamRestoreDumpFails(t *testing.T) {
+	f, l := newFakeLXD(t)
+	useLXD(t, "h1", l)
+	f.handle("POST /1.0/images", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		lxdReply(w, http.StatusBadRequest, map[string]interface{}{
+			"type": "error", "error": "Invalid tarball", "error_code": 400,
+		})
+	})
+	useRunner(t, restoreRunner("Fatal: pack 0123 is damaged"))
+
+	err := StreamRestore(context.Background(), ResticRepo{Path: "one"}, "h1", Archive{Host: "host-01", Container: "c1"}, "c1", "a1")
+	if err == nil || !strings.Contains(err.Error(), "is damaged") {
+		t.Fatalf("err = %v, want the restic error", err)
+	}
+}
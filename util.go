@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -8,3 +10,17 @@ func contains(s []string, e string) bool {
 	}
 	return false
 }
+
+// formatBytes prints n with a binary unit, e.g. 1.5 GiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}